@@ -6,18 +6,87 @@ import (
 
 	"drill/internal/config"
 	"drill/internal/transport"
+	"drill/pkg/xcrypto"
 )
 
 func main() {
 	log.Println("Client started")
 	cfg := config.LoadClientYaml("configs/client.yaml")
 	var wg sync.WaitGroup
+	var policy transport.SchedPolicy
+
+	for _, rule := range cfg.Scheduler.Rules {
+		if err := policy.AddRule(rule.Dst, rule.Class, rule.Weight); err != nil {
+			log.Panicf("Error on scheduler rule. %s\n", err)
+		}
+	}
+
+	handshake, err := transport.ParseHandshake(cfg.RemoteHandshake)
+	if err != nil {
+		log.Panicf("Error on handshake. %s\n", err)
+	}
+
+	suites, err := transport.ParseSuites(cfg.RemoteSuites)
+	if err != nil {
+		log.Panicf("Error on cipher suites. %s\n", err)
+	}
+
+	log.Printf("Key %s\n", xcrypto.Fingerprint(cfg.RemotePkey))
+
+	if cfg.RemoteIdentity == nil {
+		log.Println("Server identity isn't pinned, trusting any PSK holder")
+	} else {
+		log.Printf(
+			"Pinned server identity %s\n",
+			xcrypto.Fingerprint(cfg.RemoteIdentity),
+		)
+	}
+
+	mode, err := transport.ParsePathMode(cfg.MultipathMode)
+	if err != nil {
+		log.Panicf("Error on multipath mode. %s\n", err)
+	}
+
+	multipath := transport.Multipath {
+		Locals: cfg.MultipathLocals,
+		Remotes: cfg.MultipathAddrs,
+		Mode: mode,
+		ProbeInterval: cfg.ProbeInterval,
+	}
 
 	client := transport.NewClientTransport(
 		cfg.LocalAddr,
 		cfg.RemoteAddr,
 		cfg.RemoteProtocol,
 		cfg.RemotePkey,
+		cfg.RemoteIdentity,
+		handshake,
+		suites,
+		transport.Timeouts {
+			StreamIdle: cfg.StreamIdleTimeout,
+			SessionIdle: cfg.SessionIdleTimeout,
+			Keepalive: cfg.Keepalive,
+			Handshake: cfg.HandshakeTimeout,
+		},
+		policy,
+		cfg.Mtu,
+		multipath,
+		transport.Hopping {
+			MinPort: cfg.HopMinPort,
+			MaxPort: cfg.HopMaxPort,
+			Interval: cfg.HopInterval,
+		},
+		transport.Rekey {
+			Bytes: cfg.RekeyBytes,
+			Packets: cfg.RekeyPackets,
+			Interval: cfg.RekeyInterval,
+		},
+		transport.Shaping {
+			MinPadding: cfg.MinPadding,
+			MaxPadding: cfg.MaxPadding,
+			MinDelay: cfg.MinDelay,
+			MaxDelay: cfg.MaxDelay,
+		},
 		&wg,
 	)
 
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"os"
+	"fmt"
+	"flag"
+	"encoding/base64"
+
+	"drill/internal/config"
+	"drill/pkg/xcrypto"
+)
+
+const usage = `Usage:
+  drill keygen psk [-o FILE [-encrypt]]        new pre-shared key of a user
+  drill keygen identity [-o FILE [-encrypt]]   new static key pair of a server
+  drill encrypt -o FILE KEY                    seal a key with a passphrase
+  drill fingerprint [-identity] KEY            fingerprint of a key
+
+A KEY is a base64 key or a key file. The passphrase of an encrypted key file
+comes from $DRILL_PASSPHRASE, the agent on $DRILL_PASSPHRASE_SOCKET or a prompt.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fail("")
+	}
+
+	switch os.Args[1] {
+	case "keygen":
+		keygen(os.Args[2:])
+	case "encrypt":
+		encrypt(os.Args[2:])
+	case "fingerprint":
+		fingerprint(os.Args[2:])
+	default:
+		fail("unknown command %q", os.Args[1])
+	}
+}
+
+func fail(format string, args ...any) {
+	if format != "" {
+		fmt.Fprintf(os.Stderr, "drill: " + format + "\n", args...)
+	}
+
+	fmt.Fprint(os.Stderr, usage)
+	os.Exit(2)
+}
+
+//
+// A PSK is 32 random bytes, an identity is an X25519 key pair whose public
+// key the clients pin. The secret part goes to stdout, or to a file only its
+// owner can read.
+//
+func keygen(args []string) {
+	if len(args) < 1 {
+		fail("keygen needs a key kind, psk or identity")
+	}
+
+	kind := args[0]
+	flags := flag.NewFlagSet("keygen " + kind, flag.ExitOnError)
+	out := flags.String("o", "", "write the secret key to that file")
+	sealed := flags.Bool("encrypt", false, "seal the key file with a passphrase")
+	flags.Parse(args[1:])
+
+	if *sealed && *out == "" {
+		fail("only a key file is encrypted, -encrypt needs -o")
+	}
+
+	var secret, public []byte
+
+	switch kind {
+	case "psk":
+		secret = xcrypto.RandomKey(32)
+		public = secret
+	case "identity":
+		secret, public = xcrypto.NewKeyPair()
+	default:
+		fail("unknown key kind %q", kind)
+	}
+
+	if *out == "" {
+		fmt.Printf("key:         %s\n", base64.StdEncoding.EncodeToString(secret))
+	} else {
+		writeKey(*out, secret, *sealed)
+		fmt.Printf("key:         written to %s\n", *out)
+	}
+
+	if kind == "identity" {
+		fmt.Printf("public:      %s\n", base64.StdEncoding.EncodeToString(public))
+	}
+
+	fmt.Printf("fingerprint: %s\n", xcrypto.Fingerprint(public))
+}
+
+// Seal an existing key, e.g. one pasted in a config until now
+func encrypt(args []string) {
+	flags := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	out := flags.String("o", "", "write the encrypted key to that file")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 || *out == "" {
+		fail("encrypt needs a key and -o")
+	}
+
+	key, err := readKey(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "drill: %s\n", err)
+		os.Exit(1)
+	}
+
+	writeKey(*out, key, true)
+	fmt.Printf("key:         written to %s\n", *out)
+}
+
+func writeKey(path string, key []byte, sealed bool) {
+	var passphrase []byte
+
+	if sealed {
+		pass, err := config.NewPassphrase(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "drill: %s\n", err)
+			os.Exit(1)
+		}
+
+		passphrase = pass
+	}
+
+	if err := config.WriteKeyFile(path, key, passphrase); err != nil {
+		fmt.Fprintf(os.Stderr, "drill: can't write key file. %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// Both sides log the same fingerprints on start, so a key is compared without
+// showing it
+func fingerprint(args []string) {
+	flags := flag.NewFlagSet("fingerprint", flag.ExitOnError)
+	identity := flags.Bool("identity", false, "the key is a private identity key")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		fail("fingerprint needs a key or a key file")
+	}
+
+	key, err := readKey(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "drill: %s\n", err)
+		os.Exit(1)
+	}
+
+	if *identity {
+		key, err = xcrypto.PublicKey(key)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "drill: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	fmt.Println(xcrypto.Fingerprint(key))
+}
+
+// A key file if there is one by that name, a base64 key otherwise
+func readKey(arg string) ([]byte, error) {
+	if _, err := os.Stat(arg); err == nil {
+		return config.ReadKeyFile(arg)
+	}
+
+	key, err := base64.StdEncoding.DecodeString(arg)
+	if err != nil {
+		return nil, fmt.Errorf("%q is neither a key file nor a base64 key", arg)
+	}
+
+	return key, nil
+}
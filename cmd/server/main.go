@@ -6,6 +6,7 @@ import (
 
 	"drill/internal/config"
 	"drill/internal/transport"
+	"drill/pkg/xcrypto"
 )
 
 func main() {
@@ -13,11 +14,104 @@ func main() {
 	cfg := config.LoadServerYaml("configs/server.yaml")
 
 	var wg sync.WaitGroup
+	var policy transport.SchedPolicy
+
+	for _, rule := range cfg.Scheduler.Rules {
+		if err := policy.AddRule(rule.Dst, rule.Class, rule.Weight); err != nil {
+			log.Panicf("Error on scheduler rule. %s\n", err)
+		}
+	}
+
+	users := []*transport.User{}
+
+	for _, u := range cfg.Users {
+		user, err := transport.NewUser(u.Name, u.Pkey, u.Allow, u.MaxStreams)
+		if err != nil {
+			log.Panicf("Error on user. %s\n", err)
+		}
+
+		users = append(users, user)
+		log.Printf("User %s, key %s\n", u.Name, xcrypto.Fingerprint(u.Pkey))
+	}
+
+	var identity transport.Identity
+
+	if cfg.Identity == nil {
+		identity = transport.RandomIdentity()
+	} else {
+		id, err := transport.NewIdentity(cfg.Identity)
+		if err != nil {
+			log.Panicf("Error on server identity. %s\n", err)
+		}
+
+		identity = id
+		log.Printf("Server identity %s\n", xcrypto.Fingerprint(id.Pub))
+	}
+
+	handshake, err := transport.ParseHandshake(cfg.Handshake)
+	if err != nil {
+		log.Panicf("Error on handshake. %s\n", err)
+	}
+
+	suites, err := transport.ParseSuites(cfg.Suites)
+	if err != nil {
+		log.Panicf("Error on cipher suites. %s\n", err)
+	}
+
+	retry, err := transport.ParseRetryMode(cfg.Retry)
+	if err != nil {
+		log.Panicf("Error on retry mode. %s\n", err)
+	}
+
+	mode, err := transport.ParsePathMode(cfg.MultipathMode)
+	if err != nil {
+		log.Panicf("Error on multipath mode. %s\n", err)
+	}
+
+	multipath := transport.Multipath {
+		Remotes: cfg.MultipathAddrs,
+		Mode: mode,
+		ProbeInterval: cfg.ProbeInterval,
+	}
 
 	server := transport.NewServerTransport(
 		cfg.Addr,
 		cfg.Protocol,
-		cfg.Pkey,
+		users,
+		identity,
+		handshake,
+		suites,
+		transport.Timeouts {
+			StreamIdle: cfg.StreamIdleTimeout,
+			SessionIdle: cfg.SessionIdleTimeout,
+			Handshake: cfg.HandshakeTimeout,
+		},
+		policy,
+		cfg.Mtu,
+		multipath,
+		transport.Hopping {
+			MinPort: cfg.HopMinPort,
+			MaxPort: cfg.HopMaxPort,
+		},
+		transport.Rekey {
+			Bytes: cfg.RekeyBytes,
+			Packets: cfg.RekeyPackets,
+			Interval: cfg.RekeyInterval,
+		},
+		transport.InitLimits {
+			Rate: float64(cfg.InitRate),
+			RatePerIp: float64(cfg.InitRatePerIp),
+			Retry: retry,
+			Amplification: int(cfg.Amplification),
+			Skew: cfg.SkewTolerance,
+		},
+		cfg.Decoy,
+		transport.Shaping {
+			MinPadding: cfg.MinPadding,
+			MaxPadding: cfg.MaxPadding,
+			MinDelay: cfg.MinDelay,
+			MaxDelay: cfg.MaxDelay,
+		},
 		&wg,
 	)
 
@@ -5,6 +5,7 @@ go 1.24.2
 require (
 	github.com/goccy/go-yaml v1.18.0
 	golang.org/x/crypto v0.38.0
+	golang.org/x/term v0.32.0
 )
 
 require golang.org/x/sys v0.33.0 // indirect
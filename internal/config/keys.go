@@ -0,0 +1,100 @@
+package config
+
+import (
+	"os"
+	"log"
+	"fmt"
+	"strings"
+	"encoding/base64"
+	"drill/pkg/xcrypto"
+)
+
+//
+// A key file holds a base64 key on its first line, the way "drill keygen"
+// writes it, or the key sealed with a passphrase behind the "encrypted:"
+// prefix. Anybody reading a plain one is as good as the key's owner, so a
+// world-readable key file is refused.
+//
+const encryptedKeyPrefix = "encrypted:"
+
+func ReadKeyFile(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Mode().Perm() & 0o004 != 0 {
+		return nil, fmt.Errorf(
+			"key file %s is world-readable (%v), chmod o-r it",
+			path,
+			info.Mode().Perm(),
+		)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	line, _, _ := strings.Cut(string(data), "\n")
+	line, encrypted := strings.CutPrefix(strings.TrimSpace(line), encryptedKeyPrefix)
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line))
+	if err != nil {
+		return nil, fmt.Errorf("key file %s isn't base64. %s", path, err)
+	}
+
+	if !encrypted {
+		return key, nil
+	}
+
+	passphrase, err := Passphrase(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err = xcrypto.OpenKey(key, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("can't open key file %s. %s", path, err)
+	}
+
+	return key, nil
+}
+
+// Write a new key file only its owner can read, never over an existing one.
+// The key is sealed unless the passphrase is nil.
+func WriteKeyFile(path string, key, passphrase []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	prefix := ""
+	if passphrase != nil {
+		prefix = encryptedKeyPrefix
+		key = xcrypto.SealKey(key, passphrase)
+	}
+
+	_, err = fmt.Fprintln(file, prefix + base64.StdEncoding.EncodeToString(key))
+
+	return err
+}
+
+// A key is either inline or in a file, not both. Empty if neither is set.
+func keyOrFile(key, path, what string) string {
+	if path == "" {
+		return key
+	}
+
+	if key != "" {
+		log.Panicf("Error %s set both inline and from file %s\n", what, path)
+	}
+
+	raw, err := ReadKeyFile(path)
+	if err != nil {
+		log.Panicf("Error reading %s. %s\n", what, err)
+	}
+
+	return base64.StdEncoding.EncodeToString(raw)
+}
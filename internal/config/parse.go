@@ -4,17 +4,47 @@ import (
 	"log"
 	"net"	
 	"os"
+	"time"
+	"strconv"
+	"strings"
 	"encoding/base64"
 
 	// Third party YAML builder and parser	
 	"github.com/goccy/go-yaml"
 )
 
+// Defaults of the optional settings
+const (
+	DefaultStreamIdle 	= 30*time.Minute
+	DefaultSessionIdle 	= 90*time.Second
+	DefaultKeepalive 	= 20*time.Second
+	DefaultHandshake 	= 10*time.Second
+	DefaultMtu 			= 1400
+	DefaultProbe 		= 1*time.Second
+	DefaultHop 			= 30*time.Second
+	DefaultRekeyBytes 	= 1 << 30
+	DefaultRekey 		= 1*time.Hour
+	DefaultInitRate 	= 1000
+	DefaultInitRateIp 	= 10
+	DefaultAmplification	= 3
+	DefaultSkew 		= 30*time.Second
+	DefaultPadding 		= "0-32"
+)
+
+// Sockets a server opens for a hopping range at most
+const MaxHopPorts = 1024
+
+// Padding of a handshake datagram at most
+const MaxPadding = 1024
+
 func LoadClientYaml(cfgPath string) ReadyClientConfig {
 	data := readConfigFile(cfgPath)
 
 	var rawCfg RawClientConfig
 	parseYAML(data, &rawCfg)
+	minPort, maxPort := parsePortRange(rawCfg.Hopping.Ports)
+	minPad, maxPad := parsePaddingRange(rawCfg.Shaping.Padding)
+	minDelay, maxDelay := parseDelayRange(rawCfg.Shaping.Delay)
 
 	return ReadyClientConfig {
 		// Local	
@@ -23,7 +53,44 @@ func LoadClientYaml(cfgPath string) ReadyClientConfig {
 		// Remote
 		resolveUDPAddr(rawCfg.Server.Addr),
 		rawCfg.Server.Protocol,
-		base64ToBytes(rawCfg.Server.Pkey),
+		base64ToBytes(keyOrFile(rawCfg.Server.Pkey, rawCfg.Server.PkeyFile, "pkey")),
+		parseIdentity(rawCfg.Server.Identity, rawCfg.Server.IdentityFile),
+		rawCfg.Server.Handshake,
+		rawCfg.Server.Suites,
+
+		// Timeouts
+		parseDuration(rawCfg.Client.StreamIdle, DefaultStreamIdle),
+		parseDuration(rawCfg.Client.SessionIdle, DefaultSessionIdle),
+		parseDuration(rawCfg.Client.Keepalive, DefaultKeepalive),
+		parseDuration(rawCfg.Client.HandshakeTimeout, DefaultHandshake),
+
+		// Stream scheduling
+		rawCfg.Scheduler,
+
+		// Datagram
+		parseMtu(rawCfg.Client.Mtu),
+
+		// Multipath
+		resolveUDPAddrs(rawCfg.Multipath.Locals),
+		resolveUDPAddrs(rawCfg.Multipath.Addrs),
+		rawCfg.Multipath.Mode,
+		parseDuration(rawCfg.Multipath.ProbeInterval, DefaultProbe),
+
+		// Port hopping
+		minPort,
+		maxPort,
+		parseDuration(rawCfg.Hopping.Interval, DefaultHop),
+
+		// Rekeying
+		parseCount(rawCfg.Rekey.Bytes, DefaultRekeyBytes),
+		rawCfg.Rekey.Packets,
+		parseDuration(rawCfg.Rekey.Interval, DefaultRekey),
+
+		// Handshake shaping
+		minPad,
+		maxPad,
+		minDelay,
+		maxDelay,
 	}
 }
 
@@ -32,11 +99,61 @@ func LoadServerYaml(cfgPath string) ReadyServerConfig {
 
 	var rawCfg RawServerConfig
 	parseYAML(data, &rawCfg)
+	minPort, maxPort := parsePortRange(rawCfg.Hopping.Ports)
+	minPad, maxPad := parsePaddingRange(rawCfg.Shaping.Padding)
+	minDelay, maxDelay := parseDelayRange(rawCfg.Shaping.Delay)
 
 	return ReadyServerConfig {
 		resolveUDPAddr(rawCfg.Server.Addr),
 		rawCfg.Server.Protocol,	
-		base64ToBytes(rawCfg.Server.Pkey),
+		parseUsers(
+			keyOrFile(rawCfg.Server.Pkey, rawCfg.Server.PkeyFile, "pkey"),
+			rawCfg.Users,
+		),
+		parseIdentity(rawCfg.Server.Identity, rawCfg.Server.IdentityFile),
+		rawCfg.Server.Handshake,
+		rawCfg.Server.Suites,
+
+		// Timeouts
+		parseDuration(rawCfg.Server.StreamIdle, DefaultStreamIdle),
+		parseDuration(rawCfg.Server.SessionIdle, DefaultSessionIdle),
+		parseDuration(rawCfg.Server.HandshakeTimeout, DefaultHandshake),
+
+		// Stream scheduling
+		rawCfg.Scheduler,
+
+		// Datagram
+		parseMtu(rawCfg.Server.Mtu),
+
+		// Multipath
+		resolveUDPAddrs(rawCfg.Multipath.Addrs),
+		rawCfg.Multipath.Mode,
+		parseDuration(rawCfg.Multipath.ProbeInterval, DefaultProbe),
+
+		// Port hopping
+		minPort,
+		maxPort,
+
+		// Rekeying
+		parseCount(rawCfg.Rekey.Bytes, DefaultRekeyBytes),
+		rawCfg.Rekey.Packets,
+		parseDuration(rawCfg.Rekey.Interval, DefaultRekey),
+
+		// Handshake limits
+		rawCfg.Limits.Retry,
+		parseCount(rawCfg.Limits.InitRate, DefaultInitRate),
+		parseCount(rawCfg.Limits.InitRatePerIp, DefaultInitRateIp),
+		parseCount(rawCfg.Limits.Amplification, DefaultAmplification),
+		parseDuration(rawCfg.Limits.Skew, DefaultSkew),
+
+		// Probing resistance
+		resolveOptionalUDPAddr(rawCfg.Server.Decoy),
+
+		// Handshake shaping
+		minPad,
+		maxPad,
+		minDelay,
+		maxDelay,
 	}
 }
 
@@ -66,6 +183,170 @@ func base64ToBytes(str string) []byte {
 	return key
 }
 
+// The X25519 key of the server identity, the private one in server.yaml and
+// the pinned public one in client.yaml. Nil if unset.
+func parseIdentity(str, path string) []byte {
+	str = keyOrFile(str, path, "identity")
+
+	if str == "" {
+		return nil
+	}
+
+	key := base64ToBytes(str)
+
+	if len(key) != 32 {
+		log.Panicf("Server identity needs to be 32 bytes, got %v\n", len(key))
+	}
+
+	return key
+}
+
+// The "pkey" of the server section, if any, is the key of the "default" user
+func parseUsers(pkey string, rawUsers []UserConfig) []ReadyUserConfig {
+	if pkey != "" {
+		rawUsers = append(
+			[]UserConfig{{ Name: "default", Pkey: pkey }},
+			rawUsers...,
+		)
+	}
+
+	if len(rawUsers) == 0 {
+		log.Panicf("Error no pkey nor users configured\n")
+	}
+
+	users := []ReadyUserConfig{}
+	names := make(map[string]bool)
+	keys := make(map[string]bool)
+
+	for _, raw := range rawUsers {
+		raw.Pkey = keyOrFile(raw.Pkey, raw.PkeyFile, "pkey of " + raw.Name)
+
+		// A key shared by two users would identify only the first one
+		if names[raw.Name] || keys[raw.Pkey] {
+			log.Panicf("Error duplicate user %q or its pkey\n", raw.Name)
+		}
+
+		names[raw.Name] = true
+		keys[raw.Pkey] = true
+
+		users = append(users, ReadyUserConfig {
+			raw.Name,
+			base64ToBytes(raw.Pkey),
+			raw.Allow,
+			raw.MaxStreams,
+		})
+	}
+
+	return users
+}
+
+// Parse durations like "90s" or "30m", empty string falls back to the default
+func parseDuration(str string, def time.Duration) time.Duration {
+	if str == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(str)
+
+	if err != nil {
+		log.Panicf("Error parsing duration %q. %s\n", str, err)
+	}
+
+	return d
+}
+
+// Unset falls back to the default, a zero is kept
+func parseCount(n *uint64, def uint64) uint64 {
+	if n == nil {
+		return def
+	}
+
+	return *n
+}
+
+// The MTU has to leave room for at least a full data frame
+func parseMtu(mtu int) int {
+	if mtu == 0 {
+		return DefaultMtu
+	}
+
+	if mtu < 1200 || mtu > 65507 {
+		log.Panicf("Error MTU %v out of range [1200, 65507]\n", mtu)
+	}
+
+	return mtu
+}
+
+// Parse port ranges like "20000-20099", empty string means no range
+func parsePortRange(str string) (int, int) {
+	if str == "" {
+		return 0, 0
+	}
+
+	lo, hi, found := strings.Cut(str, "-")
+	if !found {
+		hi = lo
+	}
+
+	minPort, err1 := strconv.Atoi(strings.TrimSpace(lo))
+	maxPort, err2 := strconv.Atoi(strings.TrimSpace(hi))
+
+	if err1 != nil || err2 != nil || minPort < 1 || maxPort > 65535 || 
+		minPort > maxPort {
+		log.Panicf("Error parsing port range %q\n", str)
+	}
+
+	if maxPort - minPort + 1 > MaxHopPorts {
+		log.Panicf("Error port range %q over %v ports\n", str, MaxHopPorts)
+	}
+
+	return minPort, maxPort
+}
+
+// Parse padding ranges like "0-32" in bytes, a single number is fixed
+func parsePaddingRange(str string) (int, int) {
+	if str == "" {
+		str = DefaultPadding
+	}
+
+	lo, hi, found := strings.Cut(str, "-")
+	if !found {
+		hi = lo
+	}
+
+	minPad, err1 := strconv.Atoi(strings.TrimSpace(lo))
+	maxPad, err2 := strconv.Atoi(strings.TrimSpace(hi))
+
+	if err1 != nil || err2 != nil || minPad < 0 || maxPad > MaxPadding ||
+		minPad > maxPad {
+		log.Panicf("Error parsing padding range %q\n", str)
+	}
+
+	return minPad, maxPad
+}
+
+// Parse delay ranges like "0-20ms" or "5ms-20ms", a single duration is fixed.
+// Empty string means no delay.
+func parseDelayRange(str string) (time.Duration, time.Duration) {
+	if str == "" {
+		return 0, 0
+	}
+
+	lo, hi, found := strings.Cut(str, "-")
+	if !found {
+		hi = lo
+	}
+
+	minDelay, err1 := time.ParseDuration(strings.TrimSpace(lo))
+	maxDelay, err2 := time.ParseDuration(strings.TrimSpace(hi))
+
+	if err1 != nil || err2 != nil || minDelay < 0 || minDelay > maxDelay {
+		log.Panicf("Error parsing delay range %q\n", str)
+	}
+
+	return minDelay, maxDelay
+}
+
 func resolveTCPAddr(address string) *net.TCPAddr {
 	addr, err := net.ResolveTCPAddr("tcp", address)
 
@@ -84,4 +365,23 @@ func resolveUDPAddr(address string) *net.UDPAddr {
 	}
 
 	return addr
+}
+
+// Nil if the address is left out
+func resolveOptionalUDPAddr(address string) *net.UDPAddr {
+	if address == "" {
+		return nil
+	}
+
+	return resolveUDPAddr(address)
+}
+
+func resolveUDPAddrs(addresses []string) []*net.UDPAddr {
+	addrs := []*net.UDPAddr{}
+
+	for _, address := range addresses {
+		addrs = append(addrs, resolveUDPAddr(address))
+	}
+
+	return addrs
 }
\ No newline at end of file
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"os"
+	"fmt"
+	"net"
+	"time"
+	"bufio"
+	"bytes"
+	"strings"
+	"golang.org/x/term"
+)
+
+//
+// Where the passphrase of an encrypted key file comes from, first found wins:
+// the environment variable, an agent listening on the unix socket the other
+// variable names, or a prompt on the terminal.
+//
+// The agent gets the path of the key file on a line and answers the
+// passphrase on a line.
+//
+const (
+	PassphraseEnv 		= "DRILL_PASSPHRASE"
+	PassphraseSocketEnv = "DRILL_PASSPHRASE_SOCKET"
+)
+
+// An agent taking longer than that to answer is given up on
+const agentTimeout = 10*time.Second
+
+func Passphrase(path string) ([]byte, error) {
+	if pass, ok := os.LookupEnv(PassphraseEnv); ok {
+		return []byte(pass), nil
+	}
+
+	if socket := os.Getenv(PassphraseSocketEnv); socket != "" {
+		return agentPassphrase(socket, path)
+	}
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, fmt.Errorf(
+			"no passphrase of encrypted key file %s, set %s or %s",
+			path,
+			PassphraseEnv,
+			PassphraseSocketEnv,
+		)
+	}
+
+	return promptPassphrase(fmt.Sprintf("Passphrase of %s: ", path))
+}
+
+// A passphrase for a new key file, typed twice unless it's in the environment
+func NewPassphrase(path string) ([]byte, error) {
+	if pass, ok := os.LookupEnv(PassphraseEnv); ok {
+		if pass == "" {
+			return nil, fmt.Errorf("%s is empty", PassphraseEnv)
+		}
+
+		return []byte(pass), nil
+	}
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, fmt.Errorf("no terminal to type a passphrase, set %s", PassphraseEnv)
+	}
+
+	pass, err := promptPassphrase(fmt.Sprintf("New passphrase of %s: ", path))
+	if err != nil {
+		return nil, err
+	}
+
+	again, err := promptPassphrase("Again: ")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(pass) == 0 || !bytes.Equal(pass, again) {
+		return nil, fmt.Errorf("passphrases are empty or don't match")
+	}
+
+	return pass, nil
+}
+
+func promptPassphrase(prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+
+	return term.ReadPassword(int(os.Stdin.Fd()))
+}
+
+func agentPassphrase(socket, path string) ([]byte, error) {
+	conn, err := net.DialTimeout("unix", socket, agentTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("can't reach passphrase agent. %s", err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(agentTimeout))
+
+	if _, err := fmt.Fprintln(conn, path); err != nil {
+		return nil, fmt.Errorf("can't ask passphrase agent. %s", err)
+	}
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil && line == "" {
+		return nil, fmt.Errorf("no answer from passphrase agent. %s", err)
+	}
+
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
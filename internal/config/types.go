@@ -2,12 +2,18 @@ package config
 
 import (
 	"net"
+	"time"
 )
 
 // The struct that matches the "client" section in the client.yaml file
 type ClientConfig struct {
 	Addr string 		`yaml:"address"`
 	Pkey string			`yaml:"pkey"`
+	StreamIdle string	`yaml:"stream_idle_timeout"`
+	SessionIdle string	`yaml:"session_idle_timeout"`
+	Keepalive string	`yaml:"keepalive"`
+	HandshakeTimeout string	`yaml:"handshake_timeout"`
+	Mtu int				`yaml:"mtu"`
 }
 
 // The struct that matches the "server" section in the client.yaml 
@@ -16,17 +22,102 @@ type ServerConfig struct {
 	Addr string 		`yaml:"address"`
 	Protocol string		`yaml:"protocol"` 
 	Pkey string			`yaml:"pkey"`
+	PkeyFile string		`yaml:"pkey_file"`
+	Identity string		`yaml:"identity"`
+	IdentityFile string	`yaml:"identity_file"`
+	Handshake string	`yaml:"handshake"`
+	Suites []string		`yaml:"suites"`
+	StreamIdle string	`yaml:"stream_idle_timeout"`
+	SessionIdle string	`yaml:"session_idle_timeout"`
+	HandshakeTimeout string	`yaml:"handshake_timeout"`
+	Mtu int				`yaml:"mtu"`
+	Decoy string		`yaml:"decoy"`
+}
+
+// The struct that matches a rule in the "scheduler" section
+type SchedRuleConfig struct {
+	Dst string			`yaml:"dst"`
+	Class string		`yaml:"class"`
+	Weight int			`yaml:"weight"`
+}
+
+// The struct that matches the optional "scheduler" section in the 
+// client.yaml and server.yaml
+type SchedulerConfig struct {
+	Rules []SchedRuleConfig	`yaml:"rules"`
+}
+
+// The struct that matches the optional "multipath" section in the 
+// client.yaml and server.yaml
+type MultipathConfig struct {
+	Locals []string			`yaml:"locals"`
+	Addrs []string			`yaml:"addresses"`
+	Mode string				`yaml:"mode"`
+	ProbeInterval string	`yaml:"probe_interval"`
+}
+
+// The struct that matches the optional "hopping" section in the 
+// client.yaml and server.yaml
+type HoppingConfig struct {
+	Ports string			`yaml:"ports"`
+	Interval string			`yaml:"interval"`
+}
+
+// The struct that matches the optional "rekey" section in the client.yaml
+// and server.yaml
+type RekeyConfig struct {
+	Bytes *uint64			`yaml:"bytes"`
+	Packets uint64			`yaml:"packets"`
+	Interval string			`yaml:"interval"`
+}
+
+// The struct that matches the optional "shaping" section in the client.yaml
+// and server.yaml
+type ShapingConfig struct {
+	Padding string			`yaml:"padding"`
+	Delay string			`yaml:"delay"`
+}
+
+// The struct that matches the optional "limits" section in the server.yaml
+type LimitsConfig struct {
+	Retry string			`yaml:"retry"`
+	InitRate *uint64		`yaml:"init_rate"`
+	InitRatePerIp *uint64	`yaml:"init_rate_per_ip"`
+	Amplification *uint64	`yaml:"amplification"`
+	Skew string				`yaml:"skew_tolerance"`
+}
+
+// The struct that matches a user in the optional "users" section in the 
+// server.yaml
+type UserConfig struct {
+	Name string			`yaml:"name"`
+	Pkey string			`yaml:"pkey"`
+	PkeyFile string		`yaml:"pkey_file"`
+	Allow []string		`yaml:"allow"`
+	MaxStreams int		`yaml:"max_streams"`
 }
 
 // The struct structurally represent the client.yaml
 type RawClientConfig struct {
 	Client ClientConfig
 	Server ServerConfig
+	Scheduler SchedulerConfig
+	Multipath MultipathConfig
+	Hopping HoppingConfig
+	Rekey RekeyConfig
+	Shaping ShapingConfig
 }
 
 // The struct structurally represents the server.yaml
 type RawServerConfig struct {
 	Server ServerConfig
+	Users []UserConfig
+	Scheduler SchedulerConfig
+	Multipath MultipathConfig
+	Hopping HoppingConfig
+	Rekey RekeyConfig
+	Limits LimitsConfig
+	Shaping ShapingConfig
 }
 
 // Ready to use client side config
@@ -38,11 +129,100 @@ type ReadyClientConfig struct {
 	RemoteAddr 		*net.UDPAddr	
 	RemoteProtocol  string
 	RemotePkey      []byte
+	RemoteIdentity  []byte
+	RemoteHandshake string
+	RemoteSuites    []string
+
+	// Timeouts
+	StreamIdleTimeout 	time.Duration
+	SessionIdleTimeout 	time.Duration
+	Keepalive 			time.Duration
+	HandshakeTimeout 	time.Duration
+
+	// Stream scheduling
+	Scheduler SchedulerConfig
+
+	// Max UDP payload size of a datagram
+	Mtu int
+
+	// Local sockets and extra server addresses
+	MultipathLocals 	[]*net.UDPAddr
+	MultipathAddrs 		[]*net.UDPAddr
+	MultipathMode 		string
+	ProbeInterval 		time.Duration
+
+	// Port range of the server to hop on, no hopping if zero
+	HopMinPort 			int
+	HopMaxPort 			int
+	HopInterval 		time.Duration
+
+	// Session key updates
+	RekeyBytes 			uint64
+	RekeyPackets 		uint64
+	RekeyInterval 		time.Duration
+
+	// Random padding and delay of the handshake datagrams
+	MinPadding 			int
+	MaxPadding 			int
+	MinDelay 			time.Duration
+	MaxDelay 			time.Duration
+}
+
+// Ready to use user of the server
+type ReadyUserConfig struct {
+	Name 		string
+	Pkey 		[]byte
+	Allow 		[]string
+	MaxStreams 	int
 }
 
 // Ready to use server side config
 type ReadyServerConfig struct {
 	Addr      *net.UDPAddr 
 	Protocol  string
-	Pkey      []byte
+	Users     []ReadyUserConfig
+	Identity  []byte
+	Handshake string
+	Suites    []string
+
+	// Timeouts
+	StreamIdleTimeout 	time.Duration
+	SessionIdleTimeout 	time.Duration
+	HandshakeTimeout 	time.Duration
+
+	// Stream scheduling
+	Scheduler SchedulerConfig
+
+	// Max UDP payload size of a datagram
+	Mtu int
+
+	// Extra addresses to listen on
+	MultipathAddrs 		[]*net.UDPAddr
+	MultipathMode 		string
+	ProbeInterval 		time.Duration
+
+	// Port range to listen on as well, no hopping if zero
+	HopMinPort 			int
+	HopMaxPort 			int
+
+	// Session key updates
+	RekeyBytes 			uint64
+	RekeyPackets 		uint64
+	RekeyInterval 		time.Duration
+
+	// First datagrams of unknown addresses
+	Retry 				string
+	InitRate 			uint64
+	InitRatePerIp 		uint64
+	Amplification 		uint64
+	SkewTolerance 		time.Duration
+
+	// Where the datagrams that don't authenticate go, dropped if nil
+	Decoy 				*net.UDPAddr
+
+	// Random padding and delay of the handshake datagrams
+	MinPadding 			int
+	MaxPadding 			int
+	MinDelay 			time.Duration
+	MaxDelay 			time.Duration
 }
\ No newline at end of file
@@ -10,14 +10,22 @@ type Obfuscate interface {
 	Encode(data []byte) []byte
 	Decode(data []byte) ([]byte, error)
 	SetPkey(pkey []byte) 
+	Overhead() int
 }
 //
 // Factory function to create obfuscators
 //
 func BuildObfuscator(name string, pkey []byte) Obfuscate {
+	return BuildSuiteObfuscator(name, xcrypto.SuiteChaCha20Poly1305, pkey)
+}
+
+// Same with the given cipher suite of xcrypto
+func BuildSuiteObfuscator(name string, suite int, pkey []byte) Obfuscate {
 	switch name {
 	case "basic":
-		return NewBasicObfuscator(pkey)
+		return NewSuiteBasicObfuscator(suite, pkey)
+	case "masked":
+		return NewSuiteMaskedObfuscator(suite, pkey)
 	default:
 		return nil
 	}	
@@ -28,11 +36,17 @@ func BuildObfuscator(name string, pkey []byte) Obfuscate {
 //
 type BasicObfuscator struct {
 	Cipher xcrypto.XCipher
+	Suite int
 }
 
 func NewBasicObfuscator(pkey []byte) *BasicObfuscator {
+	return NewSuiteBasicObfuscator(xcrypto.SuiteChaCha20Poly1305, pkey)
+}
+
+func NewSuiteBasicObfuscator(suite int, pkey []byte) *BasicObfuscator {
 	return &BasicObfuscator{
-		xcrypto.NewXCipher(pkey),
+		xcrypto.NewSuiteXCipher(suite, pkey),
+		suite,
 	}
 }
 
@@ -74,5 +88,10 @@ func (bf *BasicObfuscator) Decode(data []byte) ([]byte, error) {
 }
 
 func (bf *BasicObfuscator) SetPkey(pkey []byte) {
-	bf.Cipher = xcrypto.NewXCipher(pkey)
+	bf.Cipher = xcrypto.NewSuiteXCipher(bf.Suite, pkey)
+}
+
+// Length prefix plus the cipher's nonce and tag
+func (bf *BasicObfuscator) Overhead() int {
+	return 4 + bf.Cipher.Overhead()
 }
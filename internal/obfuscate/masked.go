@@ -0,0 +1,100 @@
+package obfuscate
+
+import (
+	"fmt"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"drill/pkg/xcrypto"
+)
+
+//
+// Same as the basic one, but the length prefix is masked like QUIC protects
+// its headers: the mask comes from the header protection key and a sample of
+// the ciphertext, the AEAD tag. Every byte on the wire then looks random, a
+// datagram shows nothing but its own size.
+//
+// Encoded: MaskedSize(4) + Nonce + Ciphertext + Tag(16)
+//
+const maskSample int = 16
+
+type MaskedObfuscator struct {
+	Cipher xcrypto.XCipher
+	Suite int
+	hpKey []byte
+}
+
+func NewMaskedObfuscator(pkey []byte) *MaskedObfuscator {
+	return NewSuiteMaskedObfuscator(xcrypto.SuiteChaCha20Poly1305, pkey)
+}
+
+func NewSuiteMaskedObfuscator(suite int, pkey []byte) *MaskedObfuscator {
+	return &MaskedObfuscator{
+		xcrypto.NewSuiteXCipher(suite, pkey),
+		suite,
+		headerProtectionKey(pkey),
+	}
+}
+
+func headerProtectionKey(pkey []byte) []byte {
+	return xcrypto.DeriveKey(pkey, nil, []byte("drill header protection"), 32)
+}
+
+func (mf *MaskedObfuscator) mask(sample []byte) uint32 {
+	h := hmac.New(sha256.New, mf.hpKey)
+	h.Write(sample)
+
+	return binary.BigEndian.Uint32(h.Sum(nil))
+}
+
+func (mf *MaskedObfuscator) Encode(data []byte) []byte {
+	ciphertext := mf.Cipher.Encrypt(data)
+	sample := ciphertext[len(ciphertext)-maskSample:]
+	encoded := make([]byte, 0, 4+len(ciphertext))
+
+	encoded, _ = binary.Append(
+		encoded,
+		binary.BigEndian,
+		uint32(len(data)) ^ mf.mask(sample),
+	)
+	encoded = append(encoded, ciphertext...)
+
+	return encoded
+}
+
+func (mf *MaskedObfuscator) Decode(data []byte) ([]byte, error) {
+	if len(data) < 4 + mf.Cipher.Overhead() {
+		return []byte{}, fmt.Errorf(
+			"malform encoded data, not enough bytes to parse size out",
+		)
+	}
+
+	ciphertext := data[4:]
+	sample := ciphertext[len(ciphertext)-maskSample:]
+	size := int(binary.BigEndian.Uint32(data[0:4]) ^ mf.mask(sample))
+
+	// Tells most garbage apart without opening it
+	if size != len(ciphertext) - mf.Cipher.Overhead() {
+		return []byte{}, fmt.Errorf(
+			"malform encoded data, size doesn't match the payload",
+		)
+	}
+
+	plaintext, err := mf.Cipher.Decrypt(ciphertext)
+
+	if err != nil {
+		return []byte{}, fmt.Errorf("malform encoded data. %s", err)
+	}
+
+	return plaintext, nil
+}
+
+func (mf *MaskedObfuscator) SetPkey(pkey []byte) {
+	mf.Cipher = xcrypto.NewSuiteXCipher(mf.Suite, pkey)
+	mf.hpKey = headerProtectionKey(pkey)
+}
+
+// Masked size plus the cipher's nonce and tag
+func (mf *MaskedObfuscator) Overhead() int {
+	return 4 + mf.Cipher.Overhead()
+}
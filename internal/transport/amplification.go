@@ -0,0 +1,89 @@
+package transport
+
+import (
+	"sync"
+	"time"
+	"errors"
+)
+
+var ErrAmplification = errors.New("amplification budget of the address spent")
+
+const (
+	// Held back datagrams are tried again that often
+	ampRetryInterval = 50*time.Millisecond
+
+	// Datagrams held back at most, the next ones are dropped
+	maxHeldDatagrams int = 256
+)
+
+//
+// Bytes a server may send toward an address that didn't prove yet it receives
+// them, at most a factor of the bytes received from it. Spoofing the source
+// address of a client then doesn't turn the server into a reflector. A nil
+// budget is unlimited. Safe for concurrent use.
+//
+type AmpBudget struct {
+	mu 			sync.Mutex
+	factor 		uint64
+	received 	uint64
+	sent 		uint64
+	validated 	bool
+}
+
+// A zero factor is unlimited
+func NewAmpBudget(factor int, received int, validated bool) *AmpBudget {
+	if factor <= 0 {
+		return nil
+	}
+
+	return &AmpBudget {
+		factor: uint64(factor),
+		received: uint64(received),
+		validated: validated,
+	}
+}
+
+func (ab *AmpBudget) OnRecv(n int) {
+	if ab == nil {
+		return
+	}
+
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+
+	ab.received += uint64(n)
+}
+
+// The address proved it receives what we send, no limit anymore
+func (ab *AmpBudget) Validate() {
+	if ab == nil {
+		return
+	}
+
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+
+	ab.validated = true
+}
+
+// Tell if n more bytes may be sent, and count them if so
+func (ab *AmpBudget) Spend(n int) bool {
+	if ab == nil {
+		return true
+	}
+
+	ab.mu.Lock()
+	defer ab.mu.Unlock()
+
+	if ab.validated {
+		return true
+	}
+
+	if ab.sent + uint64(n) > ab.factor * ab.received {
+		return false
+	}
+
+	ab.sent += uint64(n)
+
+	return true
+}
@@ -1,7 +1,6 @@
 package transport
 
 import (
-	"fmt"
 	"bytes"
 	"net"
 	"time"
@@ -9,139 +8,234 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/binary"
+	"drill/pkg/xcrypto"
 )
 
-func NewRetryToken(ip net.IP, secret []byte) []byte {
-	token := make([]byte, 0, 20)
+// A retry token is echoed at once, within that time of our own clock
+const retryTokenLifetime = 2*time.Second
+
+//
+// A retry token is sealed with a key only the server knows and padded, its
+// size masked from the nonce like the masked obfuscator does. It looks like
+// random bytes of varying length; the client echoes it as is in front of its
+// INIT, the size tells the server where the INIT starts.
+//
+// Token: MaskedSize(2) + Nonce(24) + Encrypted(Time(8) + IP + Padding) + Tag(16)
+//
+const (
+	retryTokenPadding = 64
+	retryTokenMin = 2 + 24 + 8 + net.IPv4len + 16
+	retryTokenMax = 2 + 24 + 8 + net.IPv6len + retryTokenPadding + 16
+)
+
+// The client can't tell the size, but it's within the bounds
+func isRetryTokenSize(n int) bool {
+	return n >= retryTokenMin && n <= retryTokenMax
+}
+
+func retryTokenKeys(secret []byte) (xcrypto.XCipher, []byte) {
+	key := xcrypto.DeriveKey(secret, nil, []byte("drill retry token"), 32)
+	hpKey := xcrypto.DeriveKey(secret, nil, []byte("drill retry token size"), 32)
+
+	return xcrypto.NewSuiteXCipher(xcrypto.SuiteXChaCha20Poly1305, key), hpKey
+}
 
-	// Time
-	created := make([]byte, 4)
-	binary.BigEndian.PutUint32(created, uint32(time.Now().Unix()))
-	token = append(token, created...)
+func retryTokenMask(hpKey, nonce []byte) uint16 {
+	h := hmac.New(sha256.New, hpKey)
+	h.Write(nonce[:16])
 
-	// IP
-	token = append(token, ip...)
+	return binary.BigEndian.Uint16(h.Sum(nil))
+}
+
+// The padding is the shaping's, kept within retryTokenPadding
+func NewRetryToken(ip net.IP, secret []byte, shaping Shaping) []byte {
+	cphr, hpKey := retryTokenKeys(secret)
+
+	plaintext := make([]byte, 8, 8 + len(ip))
+	binary.BigEndian.PutUint64(plaintext, uint64(time.Now().UnixMilli()))
+	plaintext = append(plaintext, ip...)
+	plaintext = pad(
+		plaintext,
+		min(shaping.MinPadding, retryTokenPadding),
+		min(shaping.MaxPadding, retryTokenPadding),
+	)
 
-	// Add HMAC to ensure message integrity and verification (anti-tamper)
-	h := hmac.New(sha256.New, secret)
-	h.Write(token)
-	token = append(token, h.Sum(nil)...)
+	sealed := cphr.Encrypt(plaintext)
+	size := uint16(2 + len(sealed)) ^ retryTokenMask(hpKey, sealed)
+
+	token := make([]byte, 0, 2 + len(sealed))
+	token = binary.BigEndian.AppendUint16(token, size)
+	token = append(token, sealed...)
 
 	return token
 }
 
-func ValidateRetryToken(token []byte, ip net.IP, secret []byte) bool {
-	if len(token) < 4 + len(ip) + 32 {
-		return false
+// Gives the size of the token in front of data if it's a valid one
+func ValidateRetryToken(data []byte, ip net.IP, secret []byte) (int, bool) {
+	if len(data) < retryTokenMin {
+		return 0, false
+	}
+
+	cphr, hpKey := retryTokenKeys(secret)
+	size := int(binary.BigEndian.Uint16(data[:2]) ^ retryTokenMask(hpKey, data[2:]))
+
+	if size < retryTokenMin || size > retryTokenMax || size > len(data) {
+		return 0, false
+	}
+
+	plaintext, err := cphr.Decrypt(data[2:size])
+	if err != nil || len(plaintext) < 8 + len(ip) {
+		return 0, false
 	}
 
-	// Verify time
-	created := binary.BigEndian.Uint32(token[:4])
-	createdTime := time.Unix(int64(created), 0)
+	// Verify time, the token comes from our own clock
+	created := binary.BigEndian.Uint64(plaintext[:8])
+	createdTime := time.UnixMilli(int64(created))
 
-	if time.Since(createdTime) > 2*time.Second {
-    	return false
+	if CheckFreshness(createdTime, retryTokenLifetime, 0) != nil {
+		return 0, false
 	}
 
 	// Verify ip
-	if !bytes.Equal(token[4:4+len(ip)], ip) {
-		return false
+	if !bytes.Equal(plaintext[8:8+len(ip)], ip) {
+		return 0, false
 	}
 
-	// Verify HMAC 
-	h := hmac.New(sha256.New, secret)
-	h.Write(token[:4+len(ip)])
-	expected := h.Sum(nil)
+	return size, true
+}
+
+//
+// Prove the knowledge of a session key, so a new path can join the session
+//
+const JOIN_PROOF_SIZE int = 32 + 32
+
+func NewJoinProof(key []byte, cid uint64) []byte {
+	proof := make([]byte, 32, JOIN_PROOF_SIZE)
+	rand.Read(proof)
+
+	h := hmac.New(sha256.New, key)
+	binary.Write(h, binary.BigEndian, cid)
+	h.Write(proof)
 
-	return hmac.Equal(token[4+len(ip):], expected)
+	return h.Sum(proof)
 }
 
-type AuthToken struct {
-	Created 	time.Time
-	Challenge 	[]byte
-	Answer    	[]byte
-	Key       	[]byte
+func ValidateJoinProof(proof, key []byte, cid uint64) bool {
+	if len(proof) < JOIN_PROOF_SIZE {
+		return false
+	}
+
+	h := hmac.New(sha256.New, key)
+	binary.Write(h, binary.BigEndian, cid)
+	h.Write(proof[:32])
+
+	return hmac.Equal(proof[32:JOIN_PROOF_SIZE], h.Sum(nil))
 }
 
-func NewAuthToken(ans, key []byte) AuthToken {
-	created := time.Now().Truncate(time.Second)
-	challenge := make([]byte, 32)
-	rand.Read(challenge)
+//
+// Prove the possession of the server's static key. The key of the proof comes
+// from the DH of the static key and the client's challenge key, the proof
+// covers the given parts of the handshake.
+//
+const IDENTITY_PROOF_SIZE int = 32
 
-	return AuthToken {
-		created,
-		challenge,
-		ans,
-		key,
-	}
+func NewIdentityProof(shared []byte, transcript ...[]byte) []byte {
+	return transcriptProof(shared, "drill server identity", transcript)
 }
 
-func (t *AuthToken) AsBytes() []byte {
-	// time + challenge + answer + key
-	token := make([]byte, 0, 8+32+32+32)	
+func ValidateIdentityProof(proof, shared []byte, transcript ...[]byte) bool {
+	if len(proof) < IDENTITY_PROOF_SIZE {
+		return false
+	}
+
+	expected := NewIdentityProof(shared, transcript...)
+
+	return hmac.Equal(proof[:IDENTITY_PROOF_SIZE], expected)
+}
 
-	// Time
-	created := make([]byte, 8)
-	binary.BigEndian.PutUint64(created, uint64(t.Created.Unix()))
-	token = append(token, created...)
+//
+// Prove the client derived the session secret from the same handshake as the
+// server did, whatever a man in the middle changed on the way
+//
+const CONFIRM_PROOF_SIZE int = 32
 
-	// Challenge
-	token = append(token, t.Challenge...)
+func NewConfirmProof(secret []byte, transcript ...[]byte) []byte {
+	return transcriptProof(secret, "drill handshake transcript", transcript)
+}
 
-	// Answer
-	token = append(token, t.Answer...)
+func ValidateConfirmProof(proof, secret []byte, transcript ...[]byte) bool {
+	if len(proof) < CONFIRM_PROOF_SIZE {
+		return false
+	}
 
-	// Key
-	token = append(token, t.Key...)
+	expected := NewConfirmProof(secret, transcript...)
 
-	return token
+	return hmac.Equal(proof[:CONFIRM_PROOF_SIZE], expected)
 }
 
-func ParseAuthToken(data []byte) (AuthToken, error) {
-	// time + challenge + answer + key
-	const EXACT int = 8 + 32 + 32 + 32	
+//
+// Prove the knowledge of the resumption secret sealed in a ticket, only the
+// server could open the ticket
+//
+const RESUME_PROOF_SIZE int = 32
+
+func NewResumeProof(secret []byte, transcript ...[]byte) []byte {
+	return transcriptProof(secret, "drill resumption proof", transcript)
+}
 
-	if len(data) != EXACT {
-		return AuthToken{}, fmt.Errorf(
-			"unmatched expected token length, want %v, got %v",
-			EXACT,
-			len(data),
-		)
+func ValidateResumeProof(proof, secret []byte, transcript ...[]byte) bool {
+	if len(proof) < RESUME_PROOF_SIZE {
+		return false
 	}
 
-	// Time
-	created := time.Unix(int64(binary.BigEndian.Uint64(data[0:8])), 0)
+	expected := NewResumeProof(secret, transcript...)
 
-	// Challenge
-	challenge := make([]byte, 0, 32)
-	challenge = append(challenge, data[8:40]...)
+	return hmac.Equal(proof[:RESUME_PROOF_SIZE], expected)
+}
 
-	// Answer
-	answer := make([]byte, 0, 32)
-	answer = append(answer, data[40:72]...)
+func transcriptProof(secret []byte, label string, transcript [][]byte) []byte {
+	key := xcrypto.DeriveKey(secret, nil, []byte(label), 32)
+	h := hmac.New(sha256.New, key)
 
-	// Key
-	key := make([]byte, 0, 32)
-	key = append(key, data[72:104]...)
+	for _, part := range transcript {
+		h.Write(part)
+	}
 
-	return AuthToken {
-		created,
-		challenge,
-		answer,
-		key,
-	}, nil
+	return h.Sum(nil)
 }
 
-func (t *AuthToken) ValidateAuthToken(answer []byte) bool {	
-	// Verify time
-	if time.Since(t.Created) > 2*time.Second {
-		return false
-	}
+//
+// The session key comes from the ephemeral X25519 exchange of the handshake,
+// the PSK only authenticates it. Recording a session and later learning the
+// PSK doesn't reveal the session key.
+//
+func DeriveSessionKey(shared, psk, clientPub, serverPub []byte) []byte {
+	// Bind the key to both ephemeral public keys
+	info := []byte("drill session key")
+	info = append(info, clientPub...)
+	info = append(info, serverPub...)
+
+	return xcrypto.DeriveKey(shared, psk, info, 32)
+}
 
-	// Verify answer
-	if !bytes.Equal(answer, t.Answer) {
-		return false
+//
+// The session key of a handshake is only a secret the actual keys come from,
+// each with its own label: the key confirming the handshake, and a traffic key
+// per direction. Nothing sealed by a side opens with what the same side
+// expects from its peer, a reflected datagram is dropped.
+//
+func DeriveConfirmKey(secret []byte) []byte {
+	return xcrypto.DeriveKey(secret, nil, []byte("drill handshake confirm"), 32)
+}
+
+// Gives our sending key and our receiving key
+func DeriveTrafficKeys(secret []byte, client bool) ([]byte, []byte) {
+	c2s := xcrypto.DeriveKey(secret, nil, []byte("drill traffic c2s"), 32)
+	s2c := xcrypto.DeriveKey(secret, nil, []byte("drill traffic s2c"), 32)
+
+	if client {
+		return c2s, s2c
 	}
 
-	return true
-}
\ No newline at end of file
+	return s2c, c2s
+}
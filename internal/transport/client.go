@@ -2,13 +2,15 @@ package transport
 
 import (
 	"log"
+	"context"
+	"errors"
+	"slices"
 	"fmt"
 	"time"
 	"net"
 	"sync"
-	"drill/internal/obfuscate"
-	"drill/pkg/netio"
 	"drill/pkg/xcrypto"
+	"drill/internal/obfuscate"
 )
 
 type ClientTransport struct {
@@ -16,6 +18,18 @@ type ClientTransport struct {
 	raddr 		*net.UDPAddr
 	protocol 	string
 	pkey  		[]byte
+	identity 	[]byte
+	handshake 	int
+	suites 		[]int
+	timeouts 	Timeouts
+	policy 		SchedPolicy
+	mtu 		int
+	multipath 	Multipath
+	hopping 	Hopping
+	rekey 		Rekey
+	shaping 	Shaping
+	tickets 	*ClientTickets
+	clock 		*Clock
 	wg    	*sync.WaitGroup
 }
 
@@ -24,6 +38,16 @@ func NewClientTransport(
 	raddr *net.UDPAddr,
 	protocol string,
 	pkey  []byte,
+	identity []byte,
+	handshake int,
+	suites []int,
+	timeouts Timeouts,
+	policy SchedPolicy,
+	mtu int,
+	multipath Multipath,
+	hopping Hopping,
+	rekey Rekey,
+	shaping Shaping,
 	wg    *sync.WaitGroup,
 ) ClientTransport {
 	return ClientTransport {
@@ -31,239 +55,738 @@ func NewClientTransport(
 		raddr,
 		protocol,
 		pkey,
+		identity,
+		handshake,
+		suites,
+		timeouts,
+		policy,
+		mtu,
+		multipath,
+		hopping,
+		rekey,
+		shaping,
+		NewClientTickets(),
+		&Clock{},
 		wg,
 	}
 }
 
 func (ct *ClientTransport) Run() {
-	conn, err := net.DialUDP("udp", nil, ct.raddr)
-
+	ln, err := net.ListenTCP("tcp", ct.laddr)	
 	if err != nil {
-		log.Printf("Error dial %s: %s\n", ct.raddr, err)
+		log.Printf("Error listen on %s: %s\n", ct.laddr, err)
 		ct.wg.Done()
 		return
 	}
 
-	sendCh := make(chan []byte, 65535)
-	recvCh := make(chan []byte, 65535)
+	acceptCh := make(chan net.Conn)
+	go clientHttpsProxy(ln, acceptCh)
+
+	// Keep a session up, local connections are handed to the live one
+	for {
+		if err := ct.runSession(acceptCh); err != nil {
+			log.Printf("Session closed. %s\n", err)
+		}
+
+		time.Sleep(1*time.Second)
+	}
+}
+
+func (ct *ClientTransport) runSession(acceptCh <-chan net.Conn) error {
+	locals := ct.multipath.Locals
+	if len(locals) == 0 {
+		locals = []*net.UDPAddr{ nil }
+	}
+
+	// One socket per local address, each one reaching every server address
+	conns := []*net.UDPConn{}
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	for _, laddr := range locals {
+		conn, err := net.ListenUDP("udp", laddr)
+		if err != nil {
+			return fmt.Errorf("can't bind %s. %s", laddr, err)
+		}
+
+		conns = append(conns, conn)
+	}
+
+	// Every goroutine of the session exits once the session is gone
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The handshake runs on the primary path, the others join afterwards
+	paths := NewPathSet(ct.multipath.Mode, ct.multipath.ProbeInterval)
+	primary := NewPath(conns[0], ct.raddr)
+	paths.Add(primary)
+
+	sendCh := make(chan Outbound, 65535)
+	recvCh := make(chan Inbound, 65535)
+
+	go clientSocketSend(ctx, paths, sendCh)
+	for _, conn := range conns {
+		go clientSocketRecv(conn, paths, recvCh)
+	}
+
+	endpoints := NewEndpoints()
 
-	go clientSocketSend(conn, sendCh)
-	go clientSocketRecv(conn, recvCh)
+	// With a ticket, the CONN of a local connection already waiting rides
+	// along the resumption
+	var early *earlyStream
+	if ct.tickets.Ready() {
+		early = clientAcceptEarly(acceptCh, endpoints)
+	}
 
-	pkey2, cid, err := ct.clientHandshake(sendCh, recvCh)
+	keys, hs, resent, err := ct.clientConnect(sendCh, recvCh, early)
 	if err != nil {
-		log.Printf("Error on handshake. %s\n", err)
-		ct.wg.Done()
-		return
+		if early != nil {
+			early.conn.Close()
+			endpoints.Delete(early.pkt.Src)
+		}
+		return fmt.Errorf("error on handshake. %s", err)
+	}
+
+	pkey2 := keys.Key
+	cid := hs.Cid()
+
+	primary.Validate()
+
+	for _, conn := range conns {
+		raddrs := append([]*net.UDPAddr{ ct.raddr }, ct.multipath.Remotes...)
+
+		for _, raddr := range raddrs {
+			if conn == primary.Conn && raddr == ct.raddr {
+				continue
+			}
+
+			path := NewPath(conn, raddr)
+			go ct.clientJoin(ctx, paths, path, sendCh, cid, pkey2)
+		}
 	}
 
 	obfsCh := make(chan Packet, 65535)
-	endpoints := NewEndpoints()
+	schedCh := make(chan Packet, 32)
+	sched := NewScheduler(ct.policy)
+	idle := NewIdleTimer(ct.timeouts.SessionIdle)
 
-	var wg sync.WaitGroup
-	wg.Add(1)
+	go sched.Run(ctx, obfsCh, schedCh)
+	codec := NewDatagramCodec(ct.protocol, keys.Suite, pkey2, ct.rekey, true)
 
 	go clientObfsSend(
-		obfsCh, 
+		ctx,
+		schedCh, 
 		sendCh,
-		ct.protocol, 
-		pkey2, 
-		cid,
+		sched,
+		codec,
+		ct.mtu,
 	)
 
 	go clientObfsRecv(
+		ctx,
 		endpoints,
+		obfsCh,
 		recvCh,
-		ct.protocol, 
-		pkey2, 
-		cid,
+		sendCh,
+		codec,
+		hs,
+		idle,
+		ct.tickets,
+		ClientTicket {
+			Suite: keys.Suite,
+			Secret: DeriveResumptionSecret(pkey2),
+		},
 	)
 
-	go clientHttpsProxy(
-		endpoints,
-		obfsCh,
-		ct.laddr, 
+	if early != nil {
+		// Early data the server refused goes again as usual
+		if resent {
+			obfsCh <- early.pkt
+		}
+
+		go clientHandleEarly(
+			ctx,
+			endpoints,
+			sched,
+			*early,
+			cid,
+			ct.timeouts.StreamIdle,
+		)
+	}
+
+	// Probes double as keepalive, so they're sent even on a single path
+	interval := ct.timeouts.Keepalive
+	if len(conns) > 1 || len(ct.multipath.Remotes) > 0 {
+		interval = ct.multipath.ProbeInterval
+	}
+
+	go ProbePaths(
+		ctx,
+		paths,
+		sendCh,
+		codec,
 		cid,
+		interval,
+		true,
 	)
 
-	wg.Wait()
+	if ct.hopping.Enabled() && ct.hopping.Interval > 0 {
+		go ct.clientHop(ctx, paths, sendCh, recvCh, cid, pkey2)
+	}
+
+	idleCh := idle.Watch(ctx)
+
+	for {
+		select {
+		case conn := <-acceptCh:
+			go clientHandle(
+				ctx,
+				endpoints, 
+				obfsCh, 
+				sched,
+				conn, 
+				cid, 
+				ct.timeouts.StreamIdle,
+			)
+			break
+		case <-idleCh:
+			return fmt.Errorf("session %v idle, no response from server", cid)
+		}
+	}
 }
 
-func clientSocketSend(conn *net.UDPConn, ch <-chan []byte) {
+// Add another path to the session, going through the same retry exchange
+// as the handshake. The path carries traffic once the server is heard on it.
+func (ct *ClientTransport) clientJoin(
+	ctx context.Context,
+	paths *PathSet,
+	path *Path,
+	sendCh chan<-Outbound,
+	cid uint64,
+	pkey2 []byte,
+) bool {
+	joinCh := path.StartJoin()
+	paths.Add(path)
+
+	obfs := obfuscate.BuildObfuscator(handshakeProtocol, ct.pkey)
+	pkt := NewJoinPacket(cid, NewJoinProof(pkey2, cid))
+	pkt.Created = ct.clock.Now()
+	join := obfs.Encode(ct.shaping.Pad(pkt.AsBytes()))
+
+	ct.shaping.Wait()
+	sent := time.Now()
+	sendCh <- Outbound { Data: join, Path: path }
+
+	// The JOIN goes again behind the retry token, proving the path
+	select {
+	case token := <-joinCh:
+		path.Seed(time.Since(sent))
+		sendCh <- Outbound { Data: append(token, join...), Path: path }
+		path.EndJoin()
+		return true
+	case <-time.After(2*time.Second):
+		log.Printf("Timeout on joining path %s\n", path)
+		paths.Remove(path)
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Move every path to a fresh socket and another server port on each
+// interval. The old path is retired once the new one joined, the session
+// and its streams don't notice.
+func (ct *ClientTransport) clientHop(
+	ctx context.Context,
+	paths *PathSet,
+	sendCh chan<-Outbound,
+	recvCh chan<-Inbound,
+	cid uint64,
+	pkey2 []byte,
+) {
+	// The sockets opened here are closed along with the session
+	defer func() {
+		for _, path := range paths.All() {
+			path.Conn.Close()
+		}
+	}()
+
+	// Paths already replaced, waiting for their grace period to end
+	retiring := make(map[*Path]bool)
+
 	for {
 		select {
-		case data :=<-ch:
-			if err := netio.WriteUDP(conn, data); err != nil {
+		case <-time.After(ct.hopping.Interval):
+			break
+		case <-ctx.Done():
+			return
+		}
+
+		all := paths.All()
+		live := make(map[*Path]bool)
+
+		for _, path := range all {
+			live[path] = true
+		}
+
+		for path := range retiring {
+			if !live[path] {
+				delete(retiring, path)
+			}
+		}
+
+		for _, old := range all {
+			if retiring[old] {
+				continue
+			}
+
+			laddr := *old.Conn.LocalAddr().(*net.UDPAddr)
+			laddr.Port = 0
+
+			conn, err := net.ListenUDP("udp", &laddr)
+			if err != nil {
+				log.Printf("Error hopping path %s. %s\n", old, err)
+				continue
+			}
+
+			go clientSocketRecv(conn, paths, recvCh)
+
+			path := NewPath(conn, ct.hopping.Next(old.Addr))
+
+			if !ct.clientJoin(ctx, paths, path, sendCh, cid, pkey2) {
+				conn.Close()
+				continue
+			}
+
+			// Let the datagrams in flight on the old path arrive
+			retiring[old] = true
+			time.AfterFunc(hopGrace, func() {
+				if paths.Retire(old) {
+					old.Conn.Close()
+				}
+			})
+		}
+	}
+}
+
+func clientSocketSend(
+	ctx context.Context, 
+	paths *PathSet, 
+	ch <-chan Outbound,
+) {
+	for {
+		select {
+		case out :=<-ch:
+			if err := paths.Write(out); err != nil {
 				log.Printf("Error send data to socket. %s\n", err)
 				continue
 			}
 			break
-		case <-time.After(2000*time.Millisecond):
-			break
+		case <-ctx.Done():
+			return
 		}
 	}
 }
 
-func clientSocketRecv(conn *net.UDPConn, ch chan<-[]byte) {
+func clientSocketRecv(conn *net.UDPConn, paths *PathSet, ch chan<-Inbound) {
 	buf := make([]byte, 65535)
 
 	for {
-		n, _, err := conn.ReadFromUDP(buf)
+		n, raddr, err := conn.ReadFromUDP(buf)
+
+		// The socket is closed along with its session
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 
 		if err != nil {
 			log.Printf("Error recv data from socket. %s\n", err)
 			continue
 		}
+
+		// Drop anything not coming from the server addresses
+		path, ok := paths.Lookup(conn, raddr)
+		if !ok {
+			continue
+		}
 		
 		data := make([]byte, 0, n)
 		data = append(data, buf[:n]...)
-		ch <- data
+
+		if path.DeliverJoin(data) {
+			continue
+		}
+
+		ch <- Inbound { data, path }
 	}
 }
 
+// Resume the session from the ticket if any, falling back to a full
+// handshake. Tells if the early stream's CONN still has to be sent.
+func (ct *ClientTransport) clientConnect(
+	sendCh chan<-Outbound,
+	recvCh <-chan Inbound,
+	early *earlyStream,
+) (SessionKeys, *HandshakeState, bool, error) {
+	ticket, ok := ct.tickets.Take()
+
+	if ok && slices.Contains(ct.suites, ticket.Suite) {
+		pkts := []Packet{}
+		if early != nil {
+			pkts = append(pkts, early.pkt)
+		}
+
+		keys, hs, accepted, err := ct.clientResume(
+			sendCh,
+			recvCh,
+			ticket,
+			pkts,
+		)
+		if err == nil {
+			return keys, hs, early != nil && !accepted, nil
+		}
+
+		log.Printf("Resumption failed, full handshake. %s\n", err)
+	}
+
+	keys, hs, err := ct.clientHandshake(sendCh, recvCh)
+
+	// Once told the server's time, the handshake goes again
+	if errors.Is(err, ErrClockSkew) {
+		log.Printf("%s, handshake again\n", err)
+		keys, hs, err = ct.clientHandshake(sendCh, recvCh)
+	}
+
+	if err != nil {
+		return SessionKeys{}, nil, false, err
+	}
+
+	return keys, hs, early != nil, nil
+}
+
+// Send the ticket, our nonce and the early data in a single flight. The
+// server answers with its nonce and a proof it opened the ticket.
+func (ct *ClientTransport) clientResume(
+	sendCh chan<-Outbound,
+	recvCh <-chan Inbound,
+	ticket ClientTicket,
+	early []Packet,
+) (SessionKeys, *HandshakeState, bool, error) {
+	nonce := xcrypto.RandomKey(RESUME_NONCE_SIZE)
+	obfs := obfuscate.BuildObfuscator(handshakeProtocol, ct.pkey)
+
+	resume := NewResumePacket(EncodeResume(ct.protocol, ticket, nonce, early))
+	resume.Created = ct.clock.Now()
+
+	hs := NewHandshakeState(StepResume, 0, ct.timeouts.Handshake, ct.shaping)
+	encoded := hs.Send(sendCh, resume, obfs)
+	hs.Record(resume.Payload)
+	sent := time.Now()
+
+	// A server that doesn't take our time asks for a retry token first
+	pkt, err := hs.await(recvCh, obfs, func(data []byte) {
+		if !isRetryTokenSize(len(data)) {
+			return
+		}
+
+		token := append([]byte{}, data...)
+		ct.shaping.Wait()
+		sendCh <- Outbound { Data: append(token, encoded...) }
+	})
+	if err != nil {
+		return SessionKeys{}, nil, false, err
+	}
+
+	if pkt.Method == SKEW {
+		return SessionKeys{}, nil, false, ct.clientSkew(pkt, resume, sent)
+	}
+
+	if len(pkt.Payload) < 1 + RESUME_NONCE_SIZE + RESUME_PROOF_SIZE {
+		return SessionKeys{}, nil, false, hs.fail("malform resumption AUTH")
+	}
+
+	accepted := pkt.Payload[:1]
+	serverNonce := pkt.Payload[1:1+RESUME_NONCE_SIZE]
+	proof := pkt.Payload[1+RESUME_NONCE_SIZE:]
+
+	if !ValidateResumeProof(proof, ticket.Secret, nonce, serverNonce, accepted) {
+		return SessionKeys{}, nil, false, hs.fail(
+			"can't validate resumption proof from server",
+		)
+	}
+
+	key := DeriveResumedKey(ticket.Secret, nonce, serverNonce)
+	hs.Move(StepDone)
+
+	return SessionKeys { key, ticket.Suite }, hs, accepted[0] == 1, nil
+}
+
 func (ct *ClientTransport) clientHandshake(
-	sendCh chan <-[]byte,
-	recvCh <-chan []byte,
-) ([]byte, uint64, error) {
-	pkey1 := ct.clientInit(sendCh)
+	sendCh chan<-Outbound,
+	recvCh <-chan Inbound,
+) (SessionKeys, *HandshakeState, error) {
+	kex := NewClientKex(ct.handshake, ct.pkey, ct.identity)
+	hs := NewHandshakeState(StepInit, 0, ct.timeouts.Handshake, ct.shaping)
+
+	init, encoded, err := ct.clientInit(sendCh, kex, hs)
+	if err != nil {
+		return SessionKeys{}, nil, err
+	}
 
-	if err := ct.clientRetry(sendCh, recvCh); err != nil {
-		return []byte{}, 0, err
+	auth, err := ct.clientRetry(sendCh, recvCh, hs, init, encoded)
+	if err != nil {
+		return SessionKeys{}, nil, err
 	}
 
-	pkey2, cid, err := ct.clientAuth(sendCh, recvCh, pkey1)
+	keys, err := ct.clientAuth(sendCh, hs, auth, kex)
 	if err != nil {
-		return []byte{}, 0, err
+		return SessionKeys{}, nil, err
 	}
 
-	return pkey2, cid, nil
+	return keys, hs, nil
 }
 
-func (ct *ClientTransport) clientInit(sendCh chan <- []byte) []byte {
-	pkey1 := xcrypto.RandomKey(32)
-	obfs := obfuscate.BuildObfuscator(ct.protocol, ct.pkey)
+// Send the client's part of the key agreement, encrypted with the PSK so only
+// a server knowing it can answer. Gives the sent INIT, as is and encoded.
+func (ct *ClientTransport) clientInit(
+	sendCh chan<-Outbound,
+	kex ClientKex,
+	hs *HandshakeState,
+) (Packet, []byte, error) {
+	token, err := kex.Init()
+	if err != nil {
+		return Packet{}, nil, err
+	}
+
+	obfs := obfuscate.BuildObfuscator(handshakeProtocol, ct.pkey)
 
-	pkt := NewInitPacket(pkey1)
-	encoded := obfs.Encode(pkt.AsBytes())
+	pkt := NewInitPacket(append(encodeSuites(ct.suites), token...))
+	pkt.Created = ct.clock.Now()
 
-	sendCh <-encoded
+	encoded := hs.Send(sendCh, pkt, obfs)
+	hs.Record(pkt.Payload)
 
-	return pkey1
+	return pkt, encoded, nil
 }
 
+//
+// The server answers an INIT with AUTH, or with a retry token to echo in
+// front of the same INIT first. Gives the AUTH packet.
+//
+// Our retransmissions are the bare INIT, which fetches a fresh token should
+// the last one be lost or expired. A server that got the INIT behind a token
+// already answers it with the AUTH again.
+//
 func (ct *ClientTransport) clientRetry(
-	sendCh chan <-[]byte,
-	recvCh <-chan []byte,
+	sendCh chan<-Outbound,
+	recvCh <-chan Inbound,
+	hs *HandshakeState,
+	init Packet,
+	encoded []byte,
+) (Packet, error) {
+	obfs := obfuscate.BuildObfuscator(handshakeProtocol, ct.pkey)
+	sent := time.Now()
+
+	// Only an AUTH, or the server's time if our clock is off, decodes with
+	// the PSK. The token comes in the clear.
+	pkt, err := hs.await(recvCh, obfs, func(data []byte) {
+		if !isRetryTokenSize(len(data)) {
+			return
+		}
+
+		token := append([]byte{}, data...)
+		ct.shaping.Wait()
+		sendCh <- Outbound { Data: append(token, encoded...) }
+		hs.Move(StepRetry)
+	})
+	if err != nil {
+		return Packet{}, err
+	}
+
+	if pkt.Method == SKEW {
+		return Packet{}, ct.clientSkew(pkt, init, sent)
+	}
+
+	return pkt, nil
+}
+
+// The server refused our flight for the time it was stamped with, take its
+// time for the next one
+func (ct *ClientTransport) clientSkew(
+	pkt Packet,
+	flight Packet,
+	sent time.Time,
 ) error {
-	select {
-	case data :=<-recvCh:
-		sendCh <- data
-		return nil 
-	case <-time.After(2*time.Second):
-		return fmt.Errorf("timeout on receving retry token from server")
-	}	
+	server, err := ParseSkewPacket(pkt, flight.Payload)
+	if err != nil {
+		return err
+	}
+
+	correction := ct.clock.Adjust(server, sent)
+
+	return fmt.Errorf(
+		"%w, our clock is %v ahead of the server's",
+		ErrClockSkew,
+		-correction,
+	)
 }
 
 func (ct *ClientTransport) clientAuth(
-	sendCh chan <-[]byte,
-	recvCh <-chan []byte,
-	pkey1 []byte,
-) ([]byte, uint64, error) {
+	sendCh chan<-Outbound,
+	hs *HandshakeState,
+	auth Packet,
+	kex ClientKex,
+) (SessionKeys, error) {
 	//
-	// Recv AUTH packet from server, try to get the pkey2 from server
+	// The AUTH packet from server carries the picked cipher suite and the
+	// server's part of the key agreement. Only a server knowing the PSK could
+	// have encrypted it.
 	//
-	obfs := obfuscate.BuildObfuscator(ct.protocol, pkey1)
+	if len(auth.Payload) < 1 {
+		return SessionKeys{}, hs.fail("malform AUTH")
+	}
 
-	encoded := <-recvCh
-	decoded, err := obfs.Decode(encoded)
-	if err != nil {
-		log.Println(err)
-		return []byte{}, 0, err
+	suite := int(auth.Payload[0])
+
+	if !slices.Contains(ct.suites, suite) {
+		return SessionKeys{}, hs.fail(
+			"server picked cipher suite %v, which wasn't offered",
+			suite,
+		)
 	}
 
-	pkt, err := ParsePacket(decoded)
+	pkey2, err := kex.Finish(auth.Payload[1:])
 	if err != nil {
-		return []byte{}, 0, err
+		return SessionKeys{}, hs.wrap(err)
 	}
 
-	cid := pkt.ConnId
-	pkey2 := append([]byte{}, pkt.Payload[:32]...)
+	//
+	// Send a OK packet (encrypted with the confirm key of pkey2 and the picked
+	// suite) to server as acknowledgement, proving we saw the same INIT and
+	// AUTH as the server
+	//
+	confirm := DeriveConfirmKey(pkey2)
+	obfs := obfuscate.BuildSuiteObfuscator(handshakeProtocol, suite, confirm)
+	proof := NewConfirmProof(pkey2, hs.Transcript()...)
 
 	//
-	// Send a OK packet (encrypted with pkey2) to server as acknowledgement
+	// Nothing answers the OK, should it get lost the server sends its AUTH
+	// again, which we answer from the session
 	//
-	obfs.SetPkey(pkey2)
-	pkt = NewOkPacket(cid)
-	encoded = obfs.Encode(pkt.AsBytes())
-	sendCh <- encoded
+	hs.Send(sendCh, NewConfirmPacket(hs.Cid(), proof), obfs)
+	hs.Move(StepDone)
 
-	return pkey2, cid, nil
+	return SessionKeys { pkey2, suite }, nil
 }
 
 func clientObfsSend(
+	ctx context.Context,
 	recvCh <-chan Packet,
-	sendCh chan<-[]byte, 
-	protocol string, 
-	pkey2 []byte, 
-	cid uint64,
+	sendCh chan<-Outbound, 
+	sched *Scheduler,
+	codec *DatagramCodec,
+	mtu int,
 ) {
-	obfs := obfuscate.BuildObfuscator(protocol, pkey2)
+	packer := NewFramePacker(recvCh, mtu - codec.Overhead())
 
 	for {
-		pkt := <-recvCh
-
-		encoded := obfs.Encode(pkt.AsBytes())
+		pkts, ok := packer.Next(ctx)
+		if !ok {
+			return
+		}
 
-		sendCh <-encoded
+		sendCh <- Outbound {
+			Data: codec.Seal(pkts),
+			Urgent: sched.Urgent(pkts),
+		}
 	}	
 }
 
 func clientObfsRecv(
+	ctx context.Context,
 	endpoints *Endpoints,
-	recvCh <-chan []byte,
-	protocol string, 
-	pkey2 []byte, 
-	cid uint64,
+	obfsCh chan<-Packet,
+	recvCh <-chan Inbound,
+	sendCh chan<-Outbound,
+	codec *DatagramCodec,
+	hs *HandshakeState,
+	idle *IdleTimer,
+	tickets *ClientTickets,
+	resume ClientTicket,
 ) {
-	obfs := obfuscate.BuildObfuscator(protocol, pkey2)
 
 	for {
-		encoded := <-recvCh
+		var in Inbound
+
+		select {
+		case in = <-recvCh:
+			break
+		case <-ctx.Done():
+			return
+		}
 	
-		decoded, err := obfs.Decode(encoded)
-		if err != nil {
-			log.Printf("Err on deobfuscating encoded data. %s\n", err)
+		pkts, err := codec.Open(in.Data)
+
+		// The redundant copy of a datagram already handled, or a replay
+		if errors.Is(err, ErrReplay) {
+			in.Path.Touch()
 			continue
 		}
 
-		pkt, err := ParsePacket(decoded)
-		if err != nil {
-			log.Printf("Err on parsing the decoded data to a packet. %s\n", err)
+		// The server didn't get our OK and repeats its AUTH
+		if err != nil && hs.Repeat(in.Data) {
 			continue
 		}
 
-		ch, exists := endpoints.Get(pkt.Dst)
-
-		if !exists {
-			log.Printf("Not found dst %v\n", pkt.Dst)
+		if err != nil {
+			log.Printf("Err on opening the datagram. %s\n", err)
 			continue
 		}
 
-		ch <-pkt
-	}
-}
+		// Once heard on a joined path, the server has attached it
+		idle.Touch()
+		in.Path.Touch()
+		in.Path.Validate()
+
+		for _, pkt := range pkts {
+			//
+			// Path probes
+			//
+			if pkt.Method == PING {
+				replyProbe(sendCh, codec, in.Path, pkt)
+				continue
+			}
 
-func clientHttpsProxy(
-	endpoints *Endpoints,
-	obfsCh chan<-Packet,
-	laddr *net.TCPAddr,
-	cid uint64, 
-) {
-	ln, err := net.ListenTCP("tcp", laddr)	
-	if err != nil {
-		log.Panicf("Err listen on %s: %s\n", laddr, err)
+			if pkt.Method == PONG {
+				in.Path.OnPong(pkt.Seq)
+				continue
+			}
+
+			// A ticket for the next session
+			if pkt.Method == TICKET {
+				resume.Ticket = pkt.Payload
+				resume.Received = time.Now()
+				tickets.Save(resume)
+				continue
+			}
+
+			ch, exists := endpoints.Get(pkt.Dst)
+
+			if !exists {
+				log.Printf("Not found dst %v\n", pkt.Dst)
+				rejectStaleStream(obfsCh, pkt)
+				continue
+			}
+
+			ch <-pkt
+		}
 	}
+}
 
+func clientHttpsProxy(ln *net.TCPListener, acceptCh chan<-net.Conn) {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -271,55 +794,176 @@ func clientHttpsProxy(
 			continue
 		}
 
-		go clientHandle(endpoints, obfsCh, conn, cid)
+		acceptCh <- conn
 	}
 }
 
 func clientHandle(
+	ctx context.Context,
 	endpoints *Endpoints,
 	obfsCh chan<-Packet,
+	sched *Scheduler,
 	conn net.Conn, 
 	cid uint64,
+	idleTimeout time.Duration,
 ) {
+	// Don't outlive the session, even when blocked on the local connection
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
 	host, err := ParseHTTPConnectHost(conn)
 	if err != nil {
 		log.Printf("Err parse HTTP CONNECT host: %s\n", host)
+		conn.Close()
 		return
 	}
 
 	recvCh, localId := endpoints.Create()
+	defer endpoints.Delete(localId)
+
 	connPkt := NewConnPacket(cid, host)
 	connPkt.Src = localId
 
 	obfsCh <- connPkt
-	recvPkt := <-recvCh
+
+	clientStream(
+		ctx,
+		sched,
+		conn,
+		host,
+		recvCh,
+		cid,
+		localId,
+		idleTimeout,
+	)
+}
+
+//
+// A local connection whose CONN goes in the first flight of a resumption,
+// before the session and its cid exist
+//
+type earlyStream struct {
+	conn 		net.Conn
+	host 		string
+	recvCh 		chan Packet
+	pkt 		Packet
+}
+
+//
+// Early data is opportunistic, the session doesn't wait for it: only a local
+// connection already there rides along, and only if its CONNECT request
+// comes quickly. Any other connection waits for the session as usual.
+//
+const (
+	earlyAcceptWait 	= 100*time.Millisecond
+	earlyConnectWait 	= 1*time.Second
+)
+
+// Take a local connection if one is waiting and read its CONNECT request
+func clientAcceptEarly(
+	acceptCh <-chan net.Conn,
+	endpoints *Endpoints,
+) *earlyStream {
+	var conn net.Conn
+
+	select {
+	case conn = <-acceptCh:
+		break
+	case <-time.After(earlyAcceptWait):
+		return nil
+	}
+
+	conn.SetReadDeadline(time.Now().Add(earlyConnectWait))
+
+	host, err := ParseHTTPConnectHost(conn)
+	if err != nil {
+		log.Printf("Err parse HTTP CONNECT host: %s\n", err)
+		conn.Close()
+		return nil
+	}
+
+	conn.SetReadDeadline(time.Time{})
+
+	recvCh, localId := endpoints.Create()
+
+	connPkt := NewConnPacket(0, host)
+	connPkt.Src = localId
+
+	return &earlyStream { conn, host, recvCh, connPkt }
+}
+
+func clientHandleEarly(
+	ctx context.Context,
+	endpoints *Endpoints,
+	sched *Scheduler,
+	early earlyStream,
+	cid uint64,
+	idleTimeout time.Duration,
+) {
+	stop := context.AfterFunc(ctx, func() { early.conn.Close() })
+	defer stop()
+	defer endpoints.Delete(early.pkt.Src)
+
+	clientStream(
+		ctx,
+		sched,
+		early.conn,
+		early.host,
+		early.recvCh,
+		cid,
+		early.pkt.Src,
+		idleTimeout,
+	)
+}
+
+// Wait for the server to open the stream, then run it
+func clientStream(
+	ctx context.Context,
+	sched *Scheduler,
+	conn net.Conn,
+	host string,
+	recvCh <-chan Packet,
+	cid uint64,
+	localId uint64,
+	idleTimeout time.Duration,
+) {
+	var recvPkt Packet
+
+	select {
+	case recvPkt = <-recvCh:
+		break
+	case <-ctx.Done():
+		conn.Close()
+		return
+	}
 
 	if recvPkt.Method != OK {
 		if err := NotifyClientOnFailure(conn); err != nil {
 			log.Printf("Err notify client on faiure: %s\n", err)	
 		}
-		endpoints.Delete(localId)
+		conn.Close()
 
 		return
 	}
 
 	if err := NotifyClientOnSuccess(conn); err != nil {
 		log.Printf("Err notify client on success: %s\n", err)	
-		endpoints.Delete(localId)
+		conn.Close()
 		return
 	}
 
 	remoteId := recvPkt.Src
-	syncCh := make(chan Packet, 65535)
-
-	var wg sync.WaitGroup
-	wg.Add(2)
-	//go SendTask(&wg, conn, obfsCh, syncCh, cid, localId, remoteId)
-	go SendTask2(&wg, conn, obfsCh, syncCh, cid, localId, remoteId)
-	go RecvTask(&wg, conn, obfsCh, recvCh, syncCh, cid, localId, remoteId)
-	wg.Wait()
-
-	endpoints.Delete(localId)
-
-	return
+	streamCh := sched.Open(ctx, localId, host)
+	defer close(streamCh)
+
+	RunStream(
+		ctx, 
+		conn, 
+		streamCh, 
+		recvCh, 
+		cid, 
+		localId, 
+		remoteId, 
+		idleTimeout,
+	)
 }
@@ -0,0 +1,103 @@
+package transport
+
+import (
+	"fmt"
+	"time"
+	"bytes"
+	"errors"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync/atomic"
+)
+
+var ErrClockSkew = errors.New("clock skew with the peer")
+
+//
+// Tell if a time taken from the peer's clock is fresh: not further in the
+// future than the skew, nor older than the lifetime plus the skew. A time
+// from our own clock is checked with no skew.
+//
+func CheckFreshness(created time.Time, lifetime, skew time.Duration) error {
+	age := time.Since(created)
+
+	if age < -skew {
+		return fmt.Errorf("%w, %v ahead", ErrClockSkew, -age)
+	}
+
+	if age > lifetime + skew {
+		return fmt.Errorf("%w or a replay, %v old", ErrClockSkew, age)
+	}
+
+	return nil
+}
+
+//
+// The client's view of the server's clock. The first flight of a handshake is
+// stamped with it, so a client whose clock is off still gets through once the
+// server told its time. Safe for concurrent use.
+//
+type Clock struct {
+	offset 		atomic.Int64
+}
+
+func (c *Clock) Now() time.Time {
+	return time.Now().Add(time.Duration(c.offset.Load()))
+}
+
+// Take the server's time as of the middle of the round trip started at sent.
+// Gives the correction.
+func (c *Clock) Adjust(server time.Time, sent time.Time) time.Duration {
+	rtt := time.Since(sent)
+	correction := server.Sub(sent.Add(rtt/2).Add(time.Duration(c.offset.Load())))
+
+	c.offset.Add(int64(correction))
+
+	return correction
+}
+
+//
+// The server's answer to a first flight out of the skew tolerance, encrypted
+// with the user's key: ServerTime(8) + Echo(32)
+//
+// The echo is the hash of the flight's payload, the client takes the time only
+// from an answer to the flight it sent.
+//
+const SKEW_PAYLOAD_SIZE int = 8 + 32
+
+func NewSkewPacket(flight []byte) Packet {
+	echo := sha256.Sum256(flight)
+
+	payload := make([]byte, 0, SKEW_PAYLOAD_SIZE)
+	payload, _ = binary.Append(
+		payload,
+		binary.BigEndian,
+		uint64(time.Now().UnixMilli()),
+	)
+	payload = append(payload, echo[:]...)
+
+	return NewPacket(
+		0,
+		SKEW,
+		0,
+		0,
+		0,
+		payload,
+	)
+}
+
+// Gives the server's time, if the answer echoes the flight
+func ParseSkewPacket(pkt Packet, flight []byte) (time.Time, error) {
+	if pkt.Method != SKEW || len(pkt.Payload) < SKEW_PAYLOAD_SIZE {
+		return time.Time{}, fmt.Errorf("malform SKEW packet from server")
+	}
+
+	echo := sha256.Sum256(flight)
+
+	if !bytes.Equal(pkt.Payload[8:SKEW_PAYLOAD_SIZE], echo[:]) {
+		return time.Time{}, fmt.Errorf("SKEW packet doesn't answer our flight")
+	}
+
+	millis := binary.BigEndian.Uint64(pkt.Payload[0:8])
+
+	return time.UnixMilli(int64(millis)), nil
+}
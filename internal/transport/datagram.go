@@ -0,0 +1,404 @@
+package transport
+
+import (
+	"fmt"
+	"time"
+	"sync"
+	"context"
+	"sync/atomic"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"drill/pkg/xcrypto"
+	"drill/internal/obfuscate"
+)
+
+//
+// Once the handshake is done, a session exchanges datagrams rather than bare
+// packets. A datagram carries the fields shared by all its frames followed by
+// as many frames (data, ACK or control, of any stream) as fit in the MTU.
+// Every datagram a side sends in a session has its own packet number.
+//
+// Datagram: ConnId(8) + PacketNumber(8) + Created(8) + Frame...
+// Frame:    Method(1) + Seq(8) + Src(8) + Dst(8) + PayloadSize(2) + Payload
+//
+const DATAGRAM_HEADER int = 8 + 8 + 8
+const FRAME_HEADER int = 1 + 8 + 8 + 8 + 2
+
+func FrameSize(pkt Packet) int {
+	return FRAME_HEADER + len(pkt.Payload)
+}
+
+func EncodeDatagram(pn uint64, pkts []Packet) []byte {
+	size := DATAGRAM_HEADER
+	for _, pkt := range pkts {
+		size += FrameSize(pkt)
+	}
+
+	data := make([]byte, 0, size)
+
+	// Shared fields are taken from the first frame
+	data, _ = binary.Append(data, binary.BigEndian, pkts[0].ConnId)
+	data, _ = binary.Append(data, binary.BigEndian, pn)
+	data, _ = binary.Append(
+		data,
+		binary.BigEndian,
+		uint64(time.Now().UnixMilli()),
+	)
+
+	for _, pkt := range pkts {
+		data = append(data, pkt.Method)
+		data, _ = binary.Append(data, binary.BigEndian, pkt.Seq)
+		data, _ = binary.Append(data, binary.BigEndian, pkt.Src)
+		data, _ = binary.Append(data, binary.BigEndian, pkt.Dst)
+		data, _ = binary.Append(
+			data,
+			binary.BigEndian,
+			uint16(len(pkt.Payload)),
+		)
+		data = append(data, pkt.Payload...)
+	}
+
+	return data
+}
+
+func ParseDatagram(data []byte) (uint64, []Packet, error) {
+	if len(data) < DATAGRAM_HEADER + FRAME_HEADER {
+		return 0, nil, fmt.Errorf(
+			"not enough bytes to parse a datagram out. got %v, want %v",
+			len(data),
+			DATAGRAM_HEADER + FRAME_HEADER,
+		)
+	}
+
+	cid := binary.BigEndian.Uint64(data[0:8])
+	pn := binary.BigEndian.Uint64(data[8:16])
+	created := time.UnixMilli(int64(binary.BigEndian.Uint64(data[16:24])))
+	data = data[DATAGRAM_HEADER:]
+
+	pkts := []Packet{}
+
+	for len(data) > 0 {
+		if len(data) < FRAME_HEADER {
+			return 0, nil, fmt.Errorf(
+				"not enough bytes to parse a frame header out. got %v, want %v",
+				len(data),
+				FRAME_HEADER,
+			)
+		}
+
+		size := int(binary.BigEndian.Uint16(data[25:27]))
+
+		if len(data[FRAME_HEADER:]) < size {
+			return 0, nil, fmt.Errorf(
+				"not enough bytes to parse a frame payload out. got %v, want %v",
+				len(data[FRAME_HEADER:]),
+				size,
+			)
+		}
+
+		payload := make([]byte, 0, size)
+		payload = append(payload, data[FRAME_HEADER:FRAME_HEADER+size]...)
+
+		pkts = append(pkts, Packet {
+			cid,
+			data[0],
+			created,
+			binary.BigEndian.Uint64(data[1:9]),
+			binary.BigEndian.Uint64(data[9:17]),
+			binary.BigEndian.Uint64(data[17:25]),
+			payload,
+		})
+
+		data = data[FRAME_HEADER+size:]
+	}
+
+	return pn, pkts, nil
+}
+
+//
+// Seal and open the datagrams of a session. Sealing is safe for concurrent
+// use, opening is left to the single receiving loop of the session.
+//
+// Each direction has its own key, derived from the session secret: a
+// datagram reflected back to its sender doesn't open.
+//
+// The session secret changes by phases. Once the sender reaches the rekey
+// limits it seals with the key of the next phase. Each sealed datagram starts
+// with a byte carrying the phase, masked like the length of the masked
+// obfuscator with a key that doesn't change by phases, so the receiver opens
+// it with the one key of that phase. The low two bits of the phase are enough
+// to tell the previous, current and next phases apart. The next one means the
+// peer moved on and so do we. The previous key keeps opening the datagrams in
+// flight until a grace period after the peer is known to use the new key.
+//
+// Sealed: MaskedPhase(1) + Encoded datagram
+//
+const phaseBits byte = 0x03
+
+// Bytes of the end of the encoded datagram, the AEAD tag, the mask comes from
+const phaseSample int = 16
+
+type DatagramCodec struct {
+	protocol 	string
+	suite 		int
+	client 		bool
+	rekey 		Rekey
+	phaseKey 	[]byte
+	pn 			atomic.Uint64
+	window 		ReplayWindow
+
+	mu 			sync.Mutex
+	phase 		uint64
+	secret 		[]byte
+	send 		obfuscate.Obfuscate
+	recv 		obfuscate.Obfuscate
+	next 		obfuscate.Obfuscate
+	nextSecret 	[]byte
+	prev 		obfuscate.Obfuscate
+	prevUntil 	time.Time
+	updated 	time.Time
+	bytes 		uint64
+	packets 	uint64
+}
+
+func NewDatagramCodec(
+	protocol string,
+	suite int,
+	secret []byte,
+	rekey Rekey,
+	client bool,
+) *DatagramCodec {
+	dc := &DatagramCodec {
+		protocol: protocol,
+		suite: suite,
+		client: client,
+		rekey: rekey,
+		phaseKey: xcrypto.DeriveKey(secret, nil, []byte("drill key phase"), 32),
+	}
+
+	dc.setSecret(secret)
+
+	return dc
+}
+
+// Bytes added to the frames besides their own size
+func (dc *DatagramCodec) Overhead() int {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	return 1 + dc.send.Overhead()
+}
+
+// Current key phase, starting from 0
+func (dc *DatagramCodec) Phase() uint64 {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	return dc.phase
+}
+
+func (dc *DatagramCodec) Seal(pkts []Packet) []byte {
+	data := EncodeDatagram(dc.pn.Add(1), pkts)
+
+	dc.mu.Lock()
+	dc.expirePrev()
+
+	// Only one update at a time, the previous key has to be gone first
+	since := time.Since(dc.updated)
+	if dc.prev == nil && dc.rekey.due(dc.bytes, dc.packets, since) {
+		dc.update()
+	}
+
+	dc.bytes += uint64(len(data))
+	dc.packets += 1
+	phase, obfs := dc.phase, dc.send
+	dc.mu.Unlock()
+
+	encoded := obfs.Encode(data)
+	sealed := make([]byte, 0, 1 + len(encoded))
+	sealed = append(sealed, byte(phase) & phaseBits ^ dc.phaseMask(encoded))
+	sealed = append(sealed, encoded...)
+
+	return sealed
+}
+
+func (dc *DatagramCodec) phaseMask(encoded []byte) byte {
+	h := hmac.New(sha256.New, dc.phaseKey)
+	h.Write(encoded[len(encoded)-phaseSample:])
+
+	return h.Sum(nil)[0]
+}
+
+// A datagram whose packet number was already seen, e.g. replayed by an
+// attacker or the redundant copy from another path, gives ErrReplay
+func (dc *DatagramCodec) Open(data []byte) ([]Packet, error) {
+	decoded, err := dc.decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	pn, pkts, err := ParseDatagram(decoded)
+	if err != nil {
+		return nil, err
+	}
+
+	if !dc.window.Check(pn) {
+		return nil, ErrReplay
+	}
+
+	return pkts, nil
+}
+
+func (dc *DatagramCodec) decode(data []byte) ([]byte, error) {
+	if len(data) < 1 + phaseSample {
+		return nil, fmt.Errorf(
+			"not enough bytes to parse a key phase out. got %v, want %v",
+			len(data),
+			1 + phaseSample,
+		)
+	}
+
+	encoded := data[1:]
+	bits := data[0] ^ dc.phaseMask(encoded)
+
+	// Tells most garbage apart without opening it
+	if bits &^ phaseBits != 0 {
+		return nil, fmt.Errorf("malform datagram, bad key phase")
+	}
+
+	dc.mu.Lock()
+	dc.expirePrev()
+	phase, cur, next, prev := dc.phase, dc.recv, dc.next, dc.prev
+	dc.mu.Unlock()
+
+	switch bits {
+	case byte(phase) & phaseBits:
+		decoded, err := cur.Decode(encoded)
+		if err != nil {
+			return nil, err
+		}
+
+		dc.mu.Lock()
+		if dc.phase == phase {
+			dc.confirm()
+		}
+		dc.mu.Unlock()
+
+		return decoded, nil
+	case byte(phase + 1) & phaseBits:
+		// The peer moved to the next phase, follow it
+		decoded, err := next.Decode(encoded)
+		if err != nil {
+			return nil, err
+		}
+
+		dc.mu.Lock()
+		if dc.phase == phase {
+			dc.update()
+			dc.confirm()
+		}
+		dc.mu.Unlock()
+
+		return decoded, nil
+	default:
+		// In flight since before the last update
+		if prev == nil || bits != byte(phase - 1) & phaseBits {
+			return nil, fmt.Errorf("datagram of a phase without key")
+		}
+
+		return prev.Decode(encoded)
+	}
+}
+
+// Only the peer's key of the next phase is needed ahead, to follow it
+func (dc *DatagramCodec) setSecret(secret []byte) {
+	dc.secret = secret
+	dc.nextSecret = nextPhaseKey(secret)
+
+	send, recv := DeriveTrafficKeys(secret, dc.client)
+	_, nextRecv := DeriveTrafficKeys(dc.nextSecret, dc.client)
+
+	dc.send = obfuscate.BuildSuiteObfuscator(dc.protocol, dc.suite, send)
+	dc.recv = obfuscate.BuildSuiteObfuscator(dc.protocol, dc.suite, recv)
+	dc.next = obfuscate.BuildSuiteObfuscator(dc.protocol, dc.suite, nextRecv)
+	dc.updated = time.Now()
+	dc.bytes, dc.packets = 0, 0
+}
+
+// Move to the next phase, with the lock held
+func (dc *DatagramCodec) update() {
+	dc.prev = dc.recv
+	dc.prevUntil = time.Time{}
+	dc.phase += 1
+	dc.setSecret(dc.nextSecret)
+}
+
+// The peer uses the current key, the grace period of the previous one
+// starts. With the lock held.
+func (dc *DatagramCodec) confirm() {
+	if dc.prev != nil && dc.prevUntil.IsZero() {
+		dc.prevUntil = time.Now().Add(rekeyGrace)
+	}
+}
+
+// Forget the previous key once its grace period is over, with the lock held
+func (dc *DatagramCodec) expirePrev() {
+	if dc.prev != nil && !dc.prevUntil.IsZero() &&
+		time.Now().After(dc.prevUntil) {
+		dc.prev = nil
+	}
+}
+
+//
+// Pack the queued packets into datagrams of at most budget bytes. It never
+// waits for more packets to show up, so coalescing adds no latency.
+//
+type FramePacker struct {
+	recvCh 		<-chan Packet
+	budget 		int
+	pending 	[]Packet
+}
+
+func NewFramePacker(recvCh <-chan Packet, budget int) *FramePacker {
+	return &FramePacker {
+		recvCh: recvCh,
+		budget: budget,
+	}
+}
+
+// Block until at least one packet is available, return false once the
+// context is done
+func (fp *FramePacker) Next(ctx context.Context) ([]Packet, bool) {
+	pkts := fp.pending
+	fp.pending = nil
+
+	if len(pkts) == 0 {
+		select {
+		case pkt := <-fp.recvCh:
+			pkts = append(pkts, pkt)
+			break
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+
+	size := DATAGRAM_HEADER + FrameSize(pkts[0])
+
+	for {
+		select {
+		case pkt := <-fp.recvCh:
+			// Doesn't fit, carry it over to the next datagram
+			if size + FrameSize(pkt) > fp.budget {
+				fp.pending = append(fp.pending, pkt)
+				return pkts, true
+			}
+
+			size += FrameSize(pkt)
+			pkts = append(pkts, pkt)
+			break
+		default:
+			return pkts, true
+		}
+	}
+}
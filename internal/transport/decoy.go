@@ -0,0 +1,161 @@
+package transport
+
+import (
+	"log"
+	"net"
+	"sync"
+	"time"
+	"drill/pkg/netio"
+)
+
+const (
+	// A relay without traffic from the decoy for that long is closed
+	decoyIdle = 60*time.Second
+
+	// Sources relayed at once at most, a new one takes the place of the least
+	// recently used
+	maxDecoyRelays int = 1024
+)
+
+//
+// Whatever doesn't authenticate goes to a real UDP service, e.g. a DNS or a
+// game server, and its answers go back to the sender. A prober sees that
+// service rather than silence. A nil decoy drops everything.
+//
+// The sender is whatever the datagram claims, so the answers toward it are
+// held to the amplification budget of the datagrams it sent; past that, they
+// are dropped.
+//
+type Decoy struct {
+	addr 		*net.UDPAddr
+	factor 		int
+	maxRelays 	int
+	mu 			sync.Mutex
+	relays 		map[string]*decoyRelay
+}
+
+type decoyRelay struct {
+	conn 		*net.UDPConn
+	budget 		*AmpBudget
+	lastUsed 	time.Time
+}
+
+func NewDecoy(addr *net.UDPAddr, factor int, maxRelays int) *Decoy {
+	if addr == nil {
+		return nil
+	}
+
+	return &Decoy {
+		addr: addr,
+		factor: factor,
+		maxRelays: maxRelays,
+		relays: make(map[string]*decoyRelay),
+	}
+}
+
+// Relay a datagram received on conn from raddr to the decoy
+func (d *Decoy) Forward(conn *net.UDPConn, raddr *net.UDPAddr, data []byte) {
+	if d == nil {
+		return
+	}
+
+	relay, ok := d.relay(conn, raddr)
+	if !ok {
+		return
+	}
+
+	relay.budget.OnRecv(len(data))
+
+	if _, err := relay.conn.Write(data); err != nil {
+		log.Printf("Error forward to decoy %s. %s\n", d.addr, err)
+	}
+}
+
+func (d *Decoy) relay(conn *net.UDPConn, raddr *net.UDPAddr) (*decoyRelay, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := pathKey(conn, raddr)
+
+	if relay, ok := d.relays[key]; ok {
+		relay.lastUsed = time.Now()
+		return relay, true
+	}
+
+	if len(d.relays) >= d.maxRelays {
+		d.evict()
+	}
+
+	relayConn, err := net.DialUDP("udp", nil, d.addr)
+	if err != nil {
+		log.Printf("Error dial decoy %s. %s\n", d.addr, err)
+		return nil, false
+	}
+
+	relay := &decoyRelay {
+		conn: relayConn,
+		budget: NewAmpBudget(d.factor, 0, false),
+		lastUsed: time.Now(),
+	}
+
+	d.relays[key] = relay
+	go d.answer(key, relay, conn, raddr)
+
+	return relay, true
+}
+
+// Close the least recently used relay, its answering goroutine cleans up
+func (d *Decoy) evict() {
+	var oldestKey string
+	var oldest *decoyRelay
+
+	for key, relay := range d.relays {
+		if oldest == nil || relay.lastUsed.Before(oldest.lastUsed) {
+			oldestKey, oldest = key, relay
+		}
+	}
+
+	if oldest != nil {
+		delete(d.relays, oldestKey)
+		oldest.conn.Close()
+	}
+}
+
+// Send the decoy's answers back to the source, from the address it reached
+func (d *Decoy) answer(
+	key string,
+	relay *decoyRelay,
+	conn *net.UDPConn,
+	raddr *net.UDPAddr,
+) {
+	defer func() {
+		d.mu.Lock()
+		if d.relays[key] == relay {
+			delete(d.relays, key)
+		}
+		d.mu.Unlock()
+		relay.conn.Close()
+	}()
+
+	buf := make([]byte, 65535)
+
+	for {
+		relay.conn.SetReadDeadline(time.Now().Add(decoyIdle))
+
+		n, err := relay.conn.Read(buf)
+
+		// Timeout, evicted, or the decoy is unreachable
+		if err != nil {
+			return
+		}
+
+		// Over the budget of what the source sent
+		if !relay.budget.Spend(n) {
+			continue
+		}
+
+		if err := netio.WriteUDPAddr(conn, raddr, buf[:n]); err != nil {
+			return
+		}
+	}
+}
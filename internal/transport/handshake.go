@@ -0,0 +1,303 @@
+package transport
+
+import (
+	"fmt"
+	"errors"
+	"slices"
+	"drill/pkg/xcrypto"
+)
+
+var ErrIdentity = errors.New(
+	"server identity doesn't match the pinned public key",
+)
+
+//
+// Key agreements the handshake can run over the INIT and AUTH packets
+//
+const (
+	// Ephemeral X25519 authenticated by the PSK, HKDF for the session key
+	HandshakeBasic int = iota
+
+	// Noise_NNpsk0_25519_ChaChaPoly_SHA256
+	HandshakeNoise
+)
+
+func ParseHandshake(name string) (int, error) {
+	switch name {
+	case "basic", "":
+		return HandshakeBasic, nil
+	case "noise":
+		return HandshakeNoise, nil
+	default:
+		return 0, fmt.Errorf("unknown handshake %q", name)
+	}
+}
+
+//
+// What a handshake settles for a session
+//
+type SessionKeys struct {
+	// Secret the keys of the session are derived from
+	Key 		[]byte
+
+	// Cipher suite of xcrypto the session uses
+	Suite 		int
+}
+
+// Cipher suites by preference, every suite of xcrypto if none is given
+func ParseSuites(names []string) ([]int, error) {
+	if len(names) == 0 {
+		return append([]int{}, xcrypto.AllSuites...), nil
+	}
+
+	suites := []int{}
+
+	for _, name := range names {
+		suite, err := xcrypto.ParseSuite(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if !slices.Contains(suites, suite) {
+			suites = append(suites, suite)
+		}
+	}
+
+	return suites, nil
+}
+
+//
+// Cipher suite negotiation. The client offers its suites in front of its part
+// of the key agreement: Count(1) + Suite(1)..., the server answers with its
+// pick in front of its own part: Suite(1).
+//
+func encodeSuites(suites []int) []byte {
+	offer := []byte{ byte(len(suites)) }
+
+	for _, suite := range suites {
+		offer = append(offer, byte(suite))
+	}
+
+	return offer
+}
+
+func parseSuites(payload []byte) ([]int, []byte, error) {
+	if len(payload) < 1 || len(payload) < 1 + int(payload[0]) {
+		return nil, nil, fmt.Errorf("not enough bytes of cipher suites")
+	}
+
+	n := int(payload[0])
+	suites := []int{}
+
+	for _, suite := range payload[1:1+n] {
+		suites = append(suites, int(suite))
+	}
+
+	return suites, payload[1+n:], nil
+}
+
+// The first of our suites the peer offers, so our preference wins
+func pickSuite(ours, offered []int) (int, error) {
+	for _, suite := range ours {
+		if slices.Contains(offered, suite) {
+			return suite, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no cipher suite in common, offered %v", offered)
+}
+
+//
+// The client side of a key agreement, Init gives the INIT payload, Finish
+// takes the AUTH payload and gives the session key
+//
+type ClientKex interface {
+	Init() ([]byte, error)
+	Finish(reply []byte) ([]byte, error)
+}
+
+// The pinned public key of the server may be nil, then any server knowing the
+// PSK is trusted
+func NewClientKex(handshake int, psk, pinned []byte) ClientKex {
+	var inner ClientKex
+
+	switch handshake {
+	case HandshakeNoise:
+		inner = &noiseClientKex { state: xcrypto.NewNoiseState(psk, true) }
+	default:
+		inner = &basicClientKex { psk: psk }
+	}
+
+	return &identityClientKex { inner: inner, pinned: pinned }
+}
+
+// The server side of a key agreement, gives the AUTH payload and the session
+// key for an INIT payload
+func ServerKex(
+	handshake int,
+	identity Identity,
+	psk []byte,
+	init []byte,
+) ([]byte, []byte, error) {
+	if len(init) < 32 {
+		return nil, nil, fmt.Errorf("not enough bytes of identity challenge")
+	}
+
+	challenge := init[:32]
+
+	var reply, key []byte
+	var err error
+
+	switch handshake {
+	case HandshakeNoise:
+		reply, key, err = noiseServerKex(psk, init[32:])
+	default:
+		reply, key, err = basicServerKex(psk, init[32:])
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	shared, err := xcrypto.SharedSecret(identity.Priv, challenge)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	proof := NewIdentityProof(shared, challenge, reply)
+
+	return append(proof, reply...), key, nil
+}
+
+//
+// Every key agreement runs behind a server identity check. The client sends a
+// challenge key in front of its part, the server answers with a proof of its
+// static key over the challenge and its own part. The session key comes from
+// the server's part, so it can't be swapped without the static key.
+//
+type identityClientKex struct {
+	inner 		ClientKex
+	pinned 		[]byte
+	priv 		[]byte
+	pub 		[]byte
+}
+
+func (kex *identityClientKex) Init() ([]byte, error) {
+	kex.priv, kex.pub = xcrypto.NewKeyPair()
+
+	token, err := kex.inner.Init()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(append([]byte{}, kex.pub...), token...), nil
+}
+
+func (kex *identityClientKex) Finish(reply []byte) ([]byte, error) {
+	if len(reply) < IDENTITY_PROOF_SIZE {
+		return nil, fmt.Errorf("not enough bytes of server identity proof")
+	}
+
+	proof, rest := reply[:IDENTITY_PROOF_SIZE], reply[IDENTITY_PROOF_SIZE:]
+
+	if kex.pinned != nil {
+		shared, err := xcrypto.SharedSecret(kex.priv, kex.pinned)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ValidateIdentityProof(proof, shared, kex.pub, rest) {
+			return nil, ErrIdentity
+		}
+	}
+
+	return kex.inner.Finish(rest)
+}
+
+type basicClientKex struct {
+	psk 		[]byte
+	priv 		[]byte
+	pub 		[]byte
+}
+
+func (kex *basicClientKex) Init() ([]byte, error) {
+	kex.priv, kex.pub = xcrypto.NewKeyPair()
+
+	return kex.pub, nil
+}
+
+func (kex *basicClientKex) Finish(reply []byte) ([]byte, error) {
+	if len(reply) < 32 {
+		return nil, fmt.Errorf("not enough bytes of server's public key")
+	}
+
+	serverPub := reply[:32]
+
+	shared, err := xcrypto.SharedSecret(kex.priv, serverPub)
+	if err != nil {
+		return nil, err
+	}
+
+	return DeriveSessionKey(shared, kex.psk, kex.pub, serverPub), nil
+}
+
+func basicServerKex(psk, init []byte) ([]byte, []byte, error) {
+	if len(init) < 32 {
+		return nil, nil, fmt.Errorf("not enough bytes of client's public key")
+	}
+
+	clientPub := init[:32]
+	priv, pub := xcrypto.NewKeyPair()
+
+	shared, err := xcrypto.SharedSecret(priv, clientPub)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return pub, DeriveSessionKey(shared, psk, clientPub, pub), nil
+}
+
+// The obfuscator takes a single key for both directions, the session uses
+// the initiator's sending key
+type noiseClientKex struct {
+	state 		*xcrypto.NoiseState
+}
+
+func (kex *noiseClientKex) Init() ([]byte, error) {
+	return kex.state.WriteMessage()
+}
+
+func (kex *noiseClientKex) Finish(reply []byte) ([]byte, error) {
+	if len(reply) < xcrypto.NOISE_MSG_SIZE {
+		return nil, fmt.Errorf("not enough bytes of noise message")
+	}
+
+	if err := kex.state.ReadMessage(reply[:xcrypto.NOISE_MSG_SIZE]); err != nil {
+		return nil, err
+	}
+
+	key, _ := kex.state.Split()
+
+	return key, nil
+}
+
+func noiseServerKex(psk, init []byte) ([]byte, []byte, error) {
+	if len(init) < xcrypto.NOISE_MSG_SIZE {
+		return nil, nil, fmt.Errorf("not enough bytes of noise message")
+	}
+
+	state := xcrypto.NewNoiseState(psk, false)
+
+	if err := state.ReadMessage(init[:xcrypto.NOISE_MSG_SIZE]); err != nil {
+		return nil, nil, err
+	}
+
+	reply, err := state.WriteMessage()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, _ := state.Split()
+
+	return reply, key, nil
+}
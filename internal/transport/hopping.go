@@ -0,0 +1,61 @@
+package transport
+
+import (
+	"net"
+	"time"
+	"math/rand/v2"
+)
+
+// Old paths keep being served that long after a hop, for the datagrams
+// still in flight on them
+const hopGrace = 5*time.Second
+
+//
+// Port hopping settings, a zero value never hops. The server listens on every
+// port of the range, the client moves each path to a fresh socket and a random
+// port of the range on every interval.
+//
+type Hopping struct {
+	MinPort 	int
+	MaxPort 	int
+
+	// Client only
+	Interval 	time.Duration
+}
+
+func (h Hopping) Enabled() bool {
+	return h.MinPort > 0 && h.MaxPort >= h.MinPort
+}
+
+// The addresses to listen on for the given one, same IP and every port of
+// the range
+func (h Hopping) Addrs(addr *net.UDPAddr) []*net.UDPAddr {
+	addrs := []*net.UDPAddr{}
+
+	if !h.Enabled() {
+		return addrs
+	}
+
+	for port := h.MinPort; port <= h.MaxPort; port++ {
+		if port == addr.Port {
+			continue
+		}
+
+		addrs = append(addrs, &net.UDPAddr { 
+			IP: addr.IP, 
+			Port: port, 
+			Zone: addr.Zone,
+		})
+	}
+
+	return addrs
+}
+
+// Same IP as the given address, a random port of the range
+func (h Hopping) Next(addr *net.UDPAddr) *net.UDPAddr {
+	return &net.UDPAddr {
+		IP: addr.IP,
+		Port: h.MinPort + rand.IntN(h.MaxPort - h.MinPort + 1),
+		Zone: addr.Zone,
+	}
+}
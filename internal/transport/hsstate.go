@@ -0,0 +1,329 @@
+package transport
+
+import (
+	"fmt"
+	"time"
+	"bytes"
+	"errors"
+	"slices"
+	"drill/internal/obfuscate"
+)
+
+var ErrHandshake = errors.New("handshake failed")
+
+//
+// A handshake gives up after handshakeTimeout unless configured otherwise.
+// Meanwhile the last flight goes again when the peer's answer doesn't come,
+// waiting twice as long each time.
+//
+const (
+	handshakeTimeout = 10*time.Second
+	retransmitInitial = 250*time.Millisecond
+	retransmitMax = 2*time.Second
+)
+
+//
+// Steps of a handshake, each side goes through them in order. A step waits
+// for its own messages only, anything else is dropped and the step keeps
+// waiting until the handshake times out.
+//
+type HandshakeStep int
+
+const (
+	// Client: the INIT is out, a retry token, the AUTH or the server's time
+	// comes next
+	StepInit HandshakeStep = iota
+
+	// Client: the INIT went again behind the retry token, the AUTH or the
+	// server's time comes next
+	StepRetry
+
+	// Client: the RESUME is out, the AUTH or the server's time comes next
+	StepResume
+
+	// Server: the AUTH is out, the client's OK confirmation comes next
+	StepAuth
+
+	StepDone
+)
+
+// Handshake datagrams are masked whatever the session's protocol, from the
+// first flight on nothing on the wire is in the clear
+const handshakeProtocol = "masked"
+
+var stepNames = map[HandshakeStep]string {
+	StepInit: "INIT",
+	StepRetry: "RETRY",
+	StepResume: "RESUME",
+	StepAuth: "AUTH",
+	StepDone: "DONE",
+}
+
+var stepMethods = map[HandshakeStep][]byte {
+	StepInit: { AUTH, SKEW },
+	StepRetry: { AUTH, SKEW },
+	StepResume: { AUTH, SKEW },
+	StepAuth: { OK },
+}
+
+func (step HandshakeStep) String() string {
+	return stepNames[step]
+}
+
+//
+// Where a handshake stands: its step, the connection ID the server settled
+// and the transcript of the messages so far, which the confirmation covers.
+// It keeps our last flight and the peer's last datagram as well, the peer
+// repeating its datagram means our answer got lost.
+//
+type HandshakeState struct {
+	step 		HandshakeStep
+	cid 		uint64
+	transcript 	[][]byte
+	deadline 	time.Time
+	shaping 	Shaping
+	sendCh 		chan<-Outbound
+	flight 		[]byte
+	peer 		[]byte
+}
+
+func NewHandshakeState(
+	step HandshakeStep,
+	cid uint64,
+	timeout time.Duration,
+	shaping Shaping,
+) *HandshakeState {
+	if timeout <= 0 {
+		timeout = handshakeTimeout
+	}
+
+	return &HandshakeState {
+		step: step,
+		cid: cid,
+		deadline: time.Now().Add(timeout),
+		shaping: shaping,
+	}
+}
+
+func (hs *HandshakeState) Step() HandshakeStep {
+	return hs.step
+}
+
+func (hs *HandshakeState) Cid() uint64 {
+	return hs.cid
+}
+
+// Steps only go forward
+func (hs *HandshakeState) Move(step HandshakeStep) {
+	if step > hs.step {
+		hs.step = step
+	}
+}
+
+// Add a sent message to the transcript
+func (hs *HandshakeState) Record(payload []byte) {
+	hs.transcript = append(hs.transcript, payload)
+}
+
+func (hs *HandshakeState) Transcript() [][]byte {
+	return hs.transcript
+}
+
+//
+// Send a packet as our flight, shaped and sealed by obfs. The retransmissions
+// are the same datagram. Gives the datagram.
+//
+func (hs *HandshakeState) Send(
+	sendCh chan<-Outbound,
+	pkt Packet,
+	obfs obfuscate.Obfuscate,
+) []byte {
+	data := obfs.Encode(hs.shaping.Pad(pkt.AsBytes()))
+	hs.shaping.Wait()
+
+	hs.sendCh, hs.flight = sendCh, data
+	sendCh <- Outbound { Data: data }
+
+	return data
+}
+
+// The datagram the peer opened the handshake with, the server got it before
+// the handshake state was there
+func (hs *HandshakeState) Answer(data []byte) {
+	hs.peer = data
+}
+
+//
+// Send our flight again if the datagram repeats the peer's last one, e.g.
+// the server's AUTH after our OK got lost. The peer's datagram may come with
+// a retry token in front this time, or without one.
+//
+func (hs *HandshakeState) Repeat(data []byte) bool {
+	if hs.peer == nil || hs.flight == nil || !bytes.HasSuffix(data, hs.peer) {
+		return false
+	}
+
+	hs.sendCh <- Outbound { Data: hs.flight }
+
+	return true
+}
+
+func (hs *HandshakeState) fail(format string, args ...any) error {
+	return fmt.Errorf(
+		"%w at %s, %s",
+		ErrHandshake,
+		hs.step,
+		fmt.Sprintf(format, args...),
+	)
+}
+
+// Same, keeping the cause of the failure
+func (hs *HandshakeState) wrap(err error) error {
+	return fmt.Errorf("%w at %s, %w", ErrHandshake, hs.step, err)
+}
+
+//
+// Check the packet is what the step waits for and belongs to the handshake's
+// connection, then add it to the transcript. The client learns the connection
+// ID from the server's AUTH.
+//
+func (hs *HandshakeState) Accept(pkt Packet) error {
+	if err := hs.check(pkt); err != nil {
+		return hs.wrap(err)
+	}
+
+	if pkt.Method == SKEW {
+		return nil
+	}
+
+	if hs.cid == 0 && pkt.Method == AUTH {
+		hs.cid = pkt.ConnId
+	}
+
+	hs.Record(pkt.Payload)
+
+	return nil
+}
+
+// Same check, leaving the handshake as it is
+func (hs *HandshakeState) check(pkt Packet) error {
+	methods, ok := stepMethods[hs.step]
+	if !ok {
+		return fmt.Errorf("no message expected, got %s", MethodName(pkt.Method))
+	}
+
+	if !slices.Contains(methods, pkt.Method) {
+		return fmt.Errorf(
+			"unexpected %s, want %s",
+			MethodName(pkt.Method),
+			MethodName(methods[0]),
+		)
+	}
+
+	if pkt.Method == SKEW {
+		return nil
+	}
+
+	cid := hs.cid
+	if cid == 0 && pkt.Method == AUTH {
+		cid = pkt.ConnId
+	}
+
+	if pkt.ConnId != cid {
+		return fmt.Errorf(
+			"%s of connection %v, want %v",
+			MethodName(pkt.Method),
+			pkt.ConnId,
+			cid,
+		)
+	}
+
+	return nil
+}
+
+//
+// Wait for the message of the step, sealed by obfs. Anything else is dropped:
+// a datagram that doesn't decode, anybody may send junk to the address, as
+// well as a message the step doesn't accept, e.g. a stale retransmission or
+// a replay of an earlier handshake. Our flight goes again with backoff until
+// the message comes or the handshake times out.
+//
+func (hs *HandshakeState) Await(
+	recvCh <-chan Inbound,
+	obfs obfuscate.Obfuscate,
+) (Packet, error) {
+	return hs.await(recvCh, obfs, nil)
+}
+
+// Same, handing the datagrams that don't decode to clear
+func (hs *HandshakeState) await(
+	recvCh <-chan Inbound,
+	obfs obfuscate.Obfuscate,
+	clear func(data []byte),
+) (Packet, error) {
+	rto := retransmitInitial
+	retransmit := time.After(rto)
+	timeout := time.After(time.Until(hs.deadline))
+
+	// Told along with the timeout, it may be why the message never came
+	var dropped error
+
+	for {
+		var in Inbound
+
+		select {
+		case in = <-recvCh:
+			break
+		case <-retransmit:
+			if hs.flight != nil {
+				hs.sendCh <- Outbound { Data: hs.flight }
+			}
+
+			rto = min(2*rto, retransmitMax)
+			retransmit = time.After(rto)
+			continue
+		case <-timeout:
+			if dropped != nil {
+				return Packet{}, hs.fail(
+					"timeout waiting for %s, dropped %s",
+					MethodName(stepMethods[hs.step][0]),
+					dropped,
+				)
+			}
+
+			return Packet{}, hs.fail(
+				"timeout waiting for %s",
+				MethodName(stepMethods[hs.step][0]),
+			)
+		}
+
+		if hs.Repeat(in.Data) {
+			continue
+		}
+
+		decoded, err := obfs.Decode(in.Data)
+		if err != nil {
+			if clear != nil {
+				clear(in.Data)
+			}
+			continue
+		}
+
+		pkt, err := ParsePacket(decoded)
+		if err != nil {
+			dropped = fmt.Errorf("malform packet. %s", err)
+			continue
+		}
+
+		if err := hs.check(pkt); err != nil {
+			dropped = err
+			continue
+		}
+
+		hs.Accept(pkt)
+
+		hs.peer = in.Data
+
+		return pkt, nil
+	}
+}
@@ -0,0 +1,39 @@
+package transport
+
+import (
+	"log"
+	"encoding/base64"
+	"drill/pkg/xcrypto"
+)
+
+//
+// The long-term static X25519 key pair of the server. Clients pin its public
+// key, the server proves it holds the private key on every handshake.
+//
+type Identity struct {
+	Priv 		[]byte
+	Pub 		[]byte
+}
+
+func NewIdentity(priv []byte) (Identity, error) {
+	pub, err := xcrypto.PublicKey(priv)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	return Identity { priv, pub }, nil
+}
+
+// A throwaway identity for a server without a configured one, no client can
+// pin it across restarts
+func RandomIdentity() Identity {
+	priv, pub := xcrypto.NewKeyPair()
+
+	log.Printf(
+		"No server identity configured, using a random one %s (%s)\n",
+		base64.StdEncoding.EncodeToString(pub),
+		xcrypto.Fingerprint(pub),
+	)
+
+	return Identity { priv, pub }
+}
@@ -0,0 +1,76 @@
+package transport
+
+import (
+	"time"
+	"context"
+	"sync/atomic"
+)
+
+//
+// Idle timeouts and keepalive interval of sessions and streams. A zero
+// duration disables the corresponding timer, but a handshake always gives up
+// at some point.
+//
+type Timeouts struct {
+	StreamIdle 		time.Duration
+	SessionIdle 	time.Duration
+	Keepalive 		time.Duration
+	Handshake 		time.Duration
+}
+
+//
+// Track the last activity of a session or a stream, so the idle ones can be
+// torn down
+//
+type IdleTimer struct {
+	timeout 	time.Duration
+	last 		atomic.Int64
+}
+
+func NewIdleTimer(timeout time.Duration) *IdleTimer {
+	it := &IdleTimer {
+		timeout: timeout,
+	}
+
+	it.Touch()
+
+	return it
+}
+
+func (it *IdleTimer) Touch() {
+	it.last.Store(time.Now().UnixNano())
+}
+
+func (it *IdleTimer) Idle() time.Duration {
+	return time.Since(time.Unix(0, it.last.Load()))
+}
+
+// The returned channel is closed once no activity seen for the timeout. It is
+// never closed if the timer is disabled or the context is done first.
+func (it *IdleTimer) Watch(ctx context.Context) <-chan struct{} {
+	expired := make(chan struct{})
+
+	if it.timeout <= 0 {
+		return expired
+	}
+
+	go func() {
+		for {
+			remain := it.timeout - it.Idle()
+
+			if remain <= 0 {
+				close(expired)
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(remain):
+				break
+			}
+		}
+	}()
+
+	return expired
+}
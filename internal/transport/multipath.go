@@ -0,0 +1,447 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"context"
+	"drill/pkg/netio"
+)
+
+//
+// How a session spreads its datagrams over the paths
+//
+const (
+	// Every datagram goes on the path with the lowest RTT
+	PathMinRtt int = iota
+
+	// Like PathMinRtt, but datagrams carrying control frames or frames of
+	// interactive streams are duplicated on every usable path
+	PathRedundant
+)
+
+// Outstanding probes older than that are counted as lost
+const probeTimeout = 2*time.Second
+
+func ParsePathMode(name string) (int, error) {
+	switch name {
+	case "minrtt", "":
+		return PathMinRtt, nil
+	case "redundant":
+		return PathRedundant, nil
+	default:
+		return 0, fmt.Errorf("unknown multipath mode %q", name)
+	}
+}
+
+//
+// Multipath settings, a zero value is a plain single path session
+//
+type Multipath struct {
+	// Client: local sockets to bind, nil picks any interface
+	Locals 			[]*net.UDPAddr
+
+	// Client: server addresses besides the primary one
+	// Server: addresses to listen on besides the primary one
+	Remotes 		[]*net.UDPAddr
+
+	Mode 			int
+	ProbeInterval 	time.Duration
+}
+
+// A datagram received from a path
+type Inbound struct {
+	Data 	[]byte
+	Path 	*Path
+}
+
+// A datagram to send, on the given path or wherever the path set picks
+type Outbound struct {
+	Data 	[]byte
+	Path 	*Path
+	Urgent 	bool
+}
+
+//
+// One local socket to one remote address, with its RTT and loss estimates
+//
+type Path struct {
+	Conn 		*net.UDPConn
+	Addr 		*net.UDPAddr
+
+	mu 			sync.Mutex
+	validated 	bool
+	joinCh 		chan []byte
+	srtt 		time.Duration
+	loss 		float64
+	lastRecv 	time.Time
+	probes 		map[uint64]time.Time
+	budget 		*AmpBudget
+}
+
+func NewPath(conn *net.UDPConn, addr *net.UDPAddr) *Path {
+	return &Path {
+		Conn: conn,
+		Addr: addr,
+		lastRecv: time.Now(),
+		probes: make(map[uint64]time.Time),
+	}
+}
+
+func pathKey(conn *net.UDPConn, addr *net.UDPAddr) string {
+	return fmt.Sprintf("%s|%s", conn.LocalAddr(), addr)
+}
+
+func (p *Path) String() string {
+	return fmt.Sprintf("%s->%s", p.Conn.LocalAddr(), p.Addr)
+}
+
+func (p *Path) Write(data []byte) error {
+	if !p.Budget().Spend(len(data)) {
+		return ErrAmplification
+	}
+
+	return netio.WriteUDPAddr(p.Conn, p.Addr, data)
+}
+
+// Limit what is sent on the path until its address is validated
+func (p *Path) Limit(budget *AmpBudget) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.budget = budget
+}
+
+func (p *Path) Budget() *AmpBudget {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.budget
+}
+
+// Record that something was received from the path
+func (p *Path) Touch() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.lastRecv = time.Now()
+}
+
+// Only validated paths carry session traffic
+func (p *Path) Validate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.validated = true
+}
+
+func (p *Path) Validated() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.validated
+}
+
+// While joining, datagrams from the path go to the returned channel rather
+// than to the session
+func (p *Path) StartJoin() <-chan []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.joinCh = make(chan []byte, 16)
+
+	return p.joinCh
+}
+
+func (p *Path) EndJoin() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.joinCh = nil
+}
+
+// Hand a datagram to a pending join, tell if there was one
+func (p *Path) DeliverJoin(data []byte) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.joinCh == nil {
+		return false
+	}
+
+	select {
+	case p.joinCh <- data:
+		break
+	default:
+		break
+	}
+
+	return true
+}
+
+func (p *Path) Probe(seq uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.probes[seq] = time.Now()
+}
+
+// A probe got answered on this path, which also validates the path
+func (p *Path) OnPong(seq uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sent, ok := p.probes[seq]
+	if !ok {
+		return
+	}
+
+	delete(p.probes, seq)
+	sample := time.Since(sent)
+
+	if p.srtt == 0 {
+		p.srtt = sample
+	} else {
+		p.srtt = (7*p.srtt + sample) / 8
+	}
+
+	p.loss = 0.9*p.loss
+	p.validated = true
+}
+
+// First RTT estimate, before any probe got answered
+func (p *Path) Seed(rtt time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.srtt == 0 {
+		p.srtt = rtt
+	}
+}
+
+// Count the probes left unanswered for too long as lost
+func (p *Path) ExpireProbes() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for seq, sent := range p.probes {
+		if time.Since(sent) > probeTimeout {
+			delete(p.probes, seq)
+			p.loss = 0.9*p.loss + 0.1
+		}
+	}
+}
+
+func (p *Path) Stats() (time.Duration, float64, time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.srtt, p.loss, p.lastRecv
+}
+
+//
+// The paths of a session
+//
+type PathSet struct {
+	mu 			sync.RWMutex
+	paths 		[]*Path
+	mode 		int
+	deadAfter 	time.Duration
+}
+
+func NewPathSet(mode int, probeInterval time.Duration) *PathSet {
+	// A path silent for a few probe rounds isn't used anymore
+	deadAfter := time.Duration(0)
+	if probeInterval > 0 {
+		deadAfter = max(3*probeInterval, probeTimeout)
+	}
+
+	return &PathSet {
+		mode: mode,
+		deadAfter: deadAfter,
+	}
+}
+
+func (ps *PathSet) Add(p *Path) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	ps.paths = append(ps.paths, p)
+}
+
+func (ps *PathSet) Remove(p *Path) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	for i, path := range ps.paths {
+		if path == p {
+			ps.paths = append(ps.paths[:i], ps.paths[i+1:]...)
+			return
+		}
+	}
+}
+
+// Remove a path and tell if its socket isn't used by any other one
+func (ps *PathSet) Retire(p *Path) bool {
+	ps.Remove(p)
+
+	for _, path := range ps.All() {
+		if path.Conn == p.Conn {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (ps *PathSet) Lookup(conn *net.UDPConn, addr *net.UDPAddr) (*Path, bool) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	key := pathKey(conn, addr)
+
+	for _, p := range ps.paths {
+		if pathKey(p.Conn, p.Addr) == key {
+			return p, true
+		}
+	}
+
+	return nil, false
+}
+
+func (ps *PathSet) All() []*Path {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	return append([]*Path{}, ps.paths...)
+}
+
+func (ps *PathSet) Write(o Outbound) error {
+	if o.Path != nil {
+		return o.Path.Write(o.Data)
+	}
+
+	var err error
+
+	for _, p := range ps.pick(o.Urgent) {
+		if e := p.Write(o.Data); e != nil {
+			err = e
+		}
+	}
+
+	return err
+}
+
+func (ps *PathSet) pick(urgent bool) []*Path {
+	paths := ps.All()
+	usable := []*Path{}
+
+	for _, p := range paths {
+		_, _, lastRecv := p.Stats()
+		alive := ps.deadAfter == 0 || time.Since(lastRecv) < ps.deadAfter
+
+		if p.Validated() && alive {
+			usable = append(usable, p)
+		}
+	}
+
+	// Nothing looks healthy, fall back to the most recently heard path
+	if len(usable) == 0 {
+		var best *Path
+		var bestRecv time.Time
+
+		for _, p := range paths {
+			_, _, lastRecv := p.Stats()
+
+			if best == nil || (p.Validated() && lastRecv.After(bestRecv)) {
+				best, bestRecv = p, lastRecv
+			}
+		}
+
+		if best == nil {
+			return nil
+		}
+
+		return []*Path{ best }
+	}
+
+	if ps.mode == PathRedundant && urgent {
+		return usable
+	}
+
+	// Lossy paths look slower than they are
+	best := usable[0]
+	bestScore := -1.0
+
+	for _, p := range usable {
+		srtt, loss, _ := p.Stats()
+		score := float64(srtt) * (1 + 4*loss)
+
+		if bestScore < 0 || score < bestScore {
+			best, bestScore = p, score
+		}
+	}
+
+	return []*Path{ best }
+}
+
+//
+// Ping every path periodically, the answers feed the RTT and loss estimates.
+// Unless always is set, nothing is sent while there is a single path.
+//
+func ProbePaths(
+	ctx context.Context,
+	paths *PathSet,
+	sendCh chan<-Outbound,
+	codec *DatagramCodec,
+	cid uint64,
+	interval time.Duration,
+	always bool,
+) {
+	if interval <= 0 {
+		return
+	}
+
+	for seq := uint64(0); ; {
+		select {
+		case <-time.After(interval):
+			break
+		case <-ctx.Done():
+			return
+		}
+
+		all := paths.All()
+		if len(all) < 2 && !always {
+			continue
+		}
+
+		for _, p := range all {
+			p.ExpireProbes()
+
+			seq += 1
+			p.Probe(seq)
+
+			pkt := NewPingPacket(cid, seq)
+			sendCh <- Outbound {
+				Data: codec.Seal([]Packet{ pkt }),
+				Path: p,
+			}
+		}
+	}
+}
+
+// Answer a probe on the path it came from, so the RTT is the path's own
+func replyProbe(
+	sendCh chan<-Outbound,
+	codec *DatagramCodec,
+	path *Path,
+	pkt Packet,
+) {
+	pong := NewPongPacket(pkt.ConnId, pkt.Seq)
+
+	sendCh <- Outbound {
+		Data: codec.Seal([]Packet{ pong }),
+		Path: path,
+	}
+}
@@ -2,6 +2,7 @@ package transport
 
 import (
 	"time"
+	"context"
 	"container/heap"
 )
 
@@ -250,6 +251,7 @@ func NewPacketTimeout(seq uint64) PacketTimeout {
 }
 
 func Alert(
+	ctx context.Context,
 	trackCh <-chan Packet, 
 	clearCh <-chan uint64,
 	notifyCh chan<-Packet,
@@ -272,6 +274,8 @@ func Alert(
 		}
 
 		select {
+		case <-ctx.Done():
+			return
 		case pkt := <-trackCh:
 			queue = append(queue, NewPacketTimeout(pkt.Seq))
 			packets[pkt.Seq] = pkt
@@ -285,7 +289,12 @@ func Alert(
 
 			pkt, ok := packets[seq]
 			if ok {
-				notifyCh<-pkt
+				select {
+				case notifyCh<-pkt:
+					break
+				case <-ctx.Done():
+					return
+				}
 				queue = append(queue, NewPacketTimeout(seq))
 			} 
 			break
@@ -21,8 +21,27 @@ const (
 	RECVFIN
 	OK
 	ERR
+	RST
+	JOIN
+	RESUME
+	TICKET
+	SKEW
 )
 
+var methodNames = []string {
+	"INIT", "RETRY", "AUTH", "PING", "PONG", "FIN", "CONN", "FWD", "ACK",
+	"SENDFIN", "RECVFIN", "OK", "ERR", "RST", "JOIN", "RESUME", "TICKET",
+	"SKEW",
+}
+
+func MethodName(method byte) string {
+	if int(method) >= len(methodNames) {
+		return fmt.Sprintf("method %v", method)
+	}
+
+	return methodNames[method]
+}
+
 const NEEDED int = 8 + 1 + 8 + 8 + 8 + 8 + 4
 
 type Packet struct {
@@ -41,7 +60,7 @@ func NewPacket(
 	seq, src, dst uint64,
 	payload	[]byte,
 ) Packet {
-	created := time.Now().Truncate(time.Second)
+	created := time.Now().Truncate(time.Millisecond)
 
 	payload_copy := make([]byte, 0, len(payload))
 	payload_copy = append(payload_copy, payload...)
@@ -69,7 +88,7 @@ func (pkt *Packet) AsBytes() []byte {
 	data = append(data, pkt.Method)
 
 	// Created
-	data, _ = binary.Append(data, binary.BigEndian, uint64(pkt.Created.Unix()))
+	data, _ = binary.Append(data, binary.BigEndian, uint64(pkt.Created.UnixMilli()))
 
 	// Seq
 	data, _ = binary.Append(data, binary.BigEndian, pkt.Seq)
@@ -104,7 +123,7 @@ func ParsePacket(data []byte) (Packet, error) {
 	method := data[8]
 
 	// Created
-	created := time.Unix(int64(binary.BigEndian.Uint64(data[9:17])), 0)
+	created := time.UnixMilli(int64(binary.BigEndian.Uint64(data[9:17])))
 
 	// Seq
 	seq := binary.BigEndian.Uint64(data[17:25])
@@ -145,6 +164,7 @@ func (pkt * Packet) ValidatePacket(
 	cid uint64, 
 	method byte, 
 	seq, src, dst uint64,
+	skew time.Duration,
 ) error {
 	if cid != pkt.ConnId {
 		return fmt.Errorf(
@@ -162,8 +182,8 @@ func (pkt * Packet) ValidatePacket(
 		)
 	}
 
-	if time.Since(pkt.Created) > 1*time.Second {
-		return fmt.Errorf("can't validate Packet.Created, expired")
+	if err := CheckFreshness(pkt.Created, 1*time.Second, skew); err != nil {
+		return fmt.Errorf("can't validate Packet.Created. %w", err)
 	}
 
 	if seq != pkt.Seq {
@@ -193,12 +213,13 @@ func (pkt * Packet) ValidatePacket(
 	return nil
 }
 
+// Padded to 1200 bytes whatever the key agreement puts in it
 func NewInitPacket(token []byte) Packet {
-	if len(token) != 32 {
-		panic("INIT packet token size needs to be 32 bytes")
+	if len(token) > 1200 {
+		panic("INIT packet token size needs to be at most 1200 bytes")
 	}
 
-	padding := make([]byte, 1168)
+	padding := make([]byte, 1200 - len(token))
 	rand.Read(padding)	
 
 	payload := make([]byte, 0, 1200)
@@ -215,6 +236,55 @@ func NewInitPacket(token []byte) Packet {
 	)
 }
 
+// Same size as INIT, since it goes through the same retry exchange
+func NewJoinPacket(cid uint64, proof []byte) Packet {
+	padding := make([]byte, 1200 - len(proof))
+	rand.Read(padding)	
+
+	payload := make([]byte, 0, 1200)
+	payload = append(payload, proof...)
+	payload = append(payload, padding...)
+
+	return NewPacket(
+		cid,
+		JOIN,
+		0,
+		0,
+		0,
+		payload,
+	)
+}
+
+// Same size as INIT, it may stand for one
+func NewResumePacket(payload []byte) Packet {
+	padding := make([]byte, 1200 - len(payload))
+	rand.Read(padding)	
+
+	padded := make([]byte, 0, 1200)
+	padded = append(padded, payload...)
+	padded = append(padded, padding...)
+
+	return NewPacket(
+		0,
+		RESUME,
+		0,
+		0,
+		0,
+		padded,
+	)
+}
+
+func NewTicketPacket(cid uint64, ticket []byte) Packet {
+	return NewPacket(
+		cid,
+		TICKET,
+		0,
+		0,
+		0,
+		ticket,
+	)
+}
+
 func NewRetryPacket(token []byte) Packet {
 	return NewPacket (
 		0, 
@@ -237,6 +307,28 @@ func NewAuthPacket(cid uint64, token []byte) Packet {
 	)
 }
 
+func NewPingPacket(cid, seq uint64) Packet {
+	return NewPacket(
+		cid,
+		PING,
+		seq,
+		0,
+		0,
+		[]byte("PING"),
+	)
+}
+
+func NewPongPacket(cid, seq uint64) Packet {
+	return NewPacket(
+		cid,
+		PONG,
+		seq,
+		0,
+		0,
+		[]byte("PONG"),
+	)
+}
+
 func NewConnPacket(cid uint64, host string) Packet {
 	return NewPacket (
 		cid,
@@ -248,6 +340,18 @@ func NewConnPacket(cid uint64, host string) Packet {
 	)
 }
 
+// The client's confirmation ending a handshake, the proof covers its transcript
+func NewConfirmPacket(cid uint64, proof []byte) Packet {
+	return NewPacket(
+		cid,
+		OK,
+		0,
+		0,
+		0,
+		proof,
+	)
+}
+
 func NewOkPacket(cid uint64) Packet {
 	return NewPacket(
 		cid,
@@ -312,4 +416,15 @@ func NewRecvFinPacket(cid, seq, src, dst uint64) Packet {
 		dst,
 		[]byte("RECVFIN"),
 	)
-}
\ No newline at end of file
+}
+
+func NewRstPacket(cid, seq, src, dst uint64) Packet {
+	return NewPacket(
+		cid,
+		RST,
+		seq,
+		src,
+		dst,
+		[]byte("RST"),
+	)
+}
@@ -0,0 +1,147 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"sync/atomic"
+	"hash/maphash"
+)
+
+//
+// When a server asks a new client to echo a retry token before any session
+// state exists for it
+//
+const (
+	// Every INIT goes through the retry exchange
+	RetryAlways int = iota
+
+	// Only while many handshakes are pending, saving a round trip otherwise
+	RetryLoad
+)
+
+const (
+	// Pending handshakes beyond that count as load
+	retryLoadPending int64 = 64
+
+	// Per-IP buckets, the IPs hashing to the same one share it
+	ipBuckets int = 65536
+)
+
+func ParseRetryMode(name string) (int, error) {
+	switch name {
+	case "always", "":
+		return RetryAlways, nil
+	case "load":
+		return RetryLoad, nil
+	default:
+		return 0, fmt.Errorf("unknown retry mode %q", name)
+	}
+}
+
+//
+// Limits on the first datagrams of unknown addresses. A zero rate or
+// amplification factor is unlimited.
+//
+type InitLimits struct {
+	// First datagrams per second, over all addresses and per source IP
+	Rate 		float64
+	RatePerIp 	float64
+	Retry 		int
+
+	// Bytes sent toward an address not validated yet, at most that many
+	// times the bytes received from it
+	Amplification 	int
+
+	// Clock skew tolerated on the time a client stamps its first packet with
+	Skew 			time.Duration
+}
+
+// Token bucket holding up to a second of burst
+type bucket struct {
+	tokens 		float64
+	last 		time.Time
+}
+
+func (b *bucket) take(rate float64, now time.Time) bool {
+	burst := max(rate, 1)
+
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = min(burst, b.tokens + rate*now.Sub(b.last).Seconds())
+	}
+
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens -= 1
+
+	return true
+}
+
+//
+// Rate limits of first datagrams. The per-IP buckets are a fixed table
+// indexed by a keyed hash of the IP, so a flood from spoofed addresses costs
+// neither memory nor time, and can't aim at the bucket of a given IP.
+//
+type InitLimiter struct {
+	limits 		InitLimits
+	seed 		maphash.Seed
+	mu 			sync.Mutex
+	global 		bucket
+	perIp 		[]bucket
+	pending 	atomic.Int64
+}
+
+func NewInitLimiter(limits InitLimits) *InitLimiter {
+	il := &InitLimiter {
+		limits: limits,
+		seed: maphash.MakeSeed(),
+	}
+
+	if limits.RatePerIp > 0 {
+		il.perIp = make([]bucket, ipBuckets)
+	}
+
+	return il
+}
+
+// Tell if a first datagram from the IP may be handled
+func (il *InitLimiter) Allow(ip net.IP) bool {
+	il.mu.Lock()
+	defer il.mu.Unlock()
+
+	now := time.Now()
+
+	if il.limits.RatePerIp > 0 {
+		i := maphash.Bytes(il.seed, ip.To16()) % uint64(ipBuckets)
+
+		if !il.perIp[i].take(il.limits.RatePerIp, now) {
+			return false
+		}
+	}
+
+	if il.limits.Rate > 0 && !il.global.take(il.limits.Rate, now) {
+		return false
+	}
+
+	return true
+}
+
+// Tell if an INIT has to echo a retry token first
+func (il *InitLimiter) NeedRetry() bool {
+	return il.limits.Retry == RetryAlways ||
+		il.pending.Load() > retryLoadPending
+}
+
+// Count a handshake as pending until the returned function is called
+func (il *InitLimiter) Begin() func() {
+	il.pending.Add(1)
+
+	return sync.OnceFunc(func() { il.pending.Add(-1) })
+}
@@ -0,0 +1,31 @@
+package transport
+
+import (
+	"time"
+	"drill/pkg/xcrypto"
+)
+
+// The key of the previous phase still opens datagrams that long after an
+// update, for the ones in flight
+const rekeyGrace = 10*time.Second
+
+//
+// When a side moves the session to the next key, whichever comes first. A
+// zero field never triggers.
+//
+type Rekey struct {
+	Bytes 		uint64
+	Packets 	uint64
+	Interval 	time.Duration
+}
+
+func (r Rekey) due(bytes, packets uint64, since time.Duration) bool {
+	return (r.Bytes > 0 && bytes >= r.Bytes) ||
+		(r.Packets > 0 && packets >= r.Packets) ||
+		(r.Interval > 0 && since >= r.Interval)
+}
+
+// The key of the next phase, both sides derive it on their own
+func nextPhaseKey(key []byte) []byte {
+	return xcrypto.DeriveKey(key, nil, []byte("drill key update"), 32)
+}
@@ -0,0 +1,166 @@
+package transport
+
+import (
+	"sync"
+	"time"
+	"container/heap"
+	"errors"
+	"hash/maphash"
+)
+
+var ErrReplay = errors.New("replayed datagram")
+
+//
+// Sliding window over the packet numbers of the datagrams received in a
+// session. A number is accepted once, and only if it isn't too far behind the
+// highest one seen, so datagrams reordered by the paths still get through.
+//
+const replayWindowSize uint64 = 4096
+
+type ReplayWindow struct {
+	top 		uint64
+	bits 		[replayWindowSize / 64]uint64
+}
+
+// Tell if the packet number is fresh, and remember it if so. Packet numbers
+// start from 1.
+func (rw *ReplayWindow) Check(pn uint64) bool {
+	if pn == 0 {
+		return false
+	}
+
+	if pn > rw.top {
+		// Clear the slots the window slides over
+		if pn - rw.top >= replayWindowSize {
+			rw.bits = [replayWindowSize / 64]uint64{}
+		} else {
+			for n := rw.top + 1; n < pn; n++ {
+				rw.clear(n)
+			}
+		}
+
+		rw.top = pn
+		rw.set(pn)
+
+		return true
+	}
+
+	if rw.top - pn >= replayWindowSize || rw.isSet(pn) {
+		return false
+	}
+
+	rw.set(pn)
+
+	return true
+}
+
+func (rw *ReplayWindow) slot(pn uint64) (uint64, uint64) {
+	i := pn % replayWindowSize
+	return i / 64, uint64(1) << (i % 64)
+}
+
+func (rw *ReplayWindow) set(pn uint64) {
+	word, bit := rw.slot(pn)
+	rw.bits[word] |= bit
+}
+
+func (rw *ReplayWindow) clear(pn uint64) {
+	word, bit := rw.slot(pn)
+	rw.bits[word] &^= bit
+}
+
+func (rw *ReplayWindow) isSet(pn uint64) bool {
+	word, bit := rw.slot(pn)
+	return rw.bits[word] & bit != 0
+}
+
+//
+// Bounded cache of the handshake datagrams seen while they are fresh. Each one
+// is remembered until its freshness check would turn it down anyway. Once the
+// cache is full, the one closest to that is forgotten first, so a flood only
+// makes room for replays that are about to go stale. Safe for concurrent use.
+//
+// At the default rate limit, the cache holds every first flight of a whole
+// freshness window.
+//
+const replayCacheSize int = 1 << 16
+
+type ReplayCache struct {
+	mu 			sync.Mutex
+	seed 		maphash.Seed
+	seen 		map[uint64]time.Time
+	expiries 	replayHeap
+}
+
+type replayEntry struct {
+	sum 		uint64
+	expires 	time.Time
+}
+
+func NewReplayCache() *ReplayCache {
+	return &ReplayCache {
+		seed: maphash.MakeSeed(),
+		seen: make(map[uint64]time.Time),
+	}
+}
+
+// Tell if the data was already seen, without remembering it
+func (rc *ReplayCache) Contains(data []byte) bool {
+	sum := maphash.Bytes(rc.seed, data)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	expires, ok := rc.seen[sum]
+
+	return ok && !expires.Before(time.Now())
+}
+
+// Tell if the data was already seen, remember it until expires otherwise
+func (rc *ReplayCache) Seen(data []byte, expires time.Time) bool {
+	sum := maphash.Bytes(rc.seed, data)
+	now := time.Now()
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.expire(now)
+
+	if _, ok := rc.seen[sum]; ok {
+		return true
+	}
+
+	if len(rc.expiries) >= replayCacheSize {
+		entry := heap.Pop(&rc.expiries).(replayEntry)
+		delete(rc.seen, entry.sum)
+	}
+
+	rc.seen[sum] = expires
+	heap.Push(&rc.expiries, replayEntry { sum, expires })
+
+	return false
+}
+
+// Forget what expired, soonest first
+func (rc *ReplayCache) expire(now time.Time) {
+	for len(rc.expiries) > 0 && rc.expiries[0].expires.Before(now) {
+		entry := heap.Pop(&rc.expiries).(replayEntry)
+		delete(rc.seen, entry.sum)
+	}
+}
+
+// Entries by expiry, for container/heap
+type replayHeap []replayEntry
+
+func (h replayHeap) Len() int { return len(h) }
+func (h replayHeap) Less(i, j int) bool { return h[i].expires.Before(h[j].expires) }
+func (h replayHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *replayHeap) Push(x any) { *h = append(*h, x.(replayEntry)) }
+
+func (h *replayHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return entry
+}
@@ -0,0 +1,294 @@
+package transport
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"encoding/binary"
+	"drill/pkg/xcrypto"
+	"drill/internal/obfuscate"
+)
+
+const (
+	// A ticket older than that isn't accepted anymore
+	ticketLifetime = 1*time.Hour
+
+	// The server hands out a fresh ticket that often during a session
+	ticketReissue = ticketLifetime / 2
+
+	// CONNs at most carried by the first flight of a resumption
+	maxEarlyStreams int = 4
+
+	RESUME_NONCE_SIZE int = 32
+)
+
+//
+// The resumption secret of a session, both sides derive it from the session
+// key. It's never sent, the server seals it in the tickets it issues.
+//
+func DeriveResumptionSecret(key []byte) []byte {
+	return xcrypto.DeriveKey(key, nil, []byte("drill resumption"), 32)
+}
+
+// Key of the early data in the first flight of a resumption
+func DeriveEarlyKey(secret, clientNonce []byte) []byte {
+	return xcrypto.DeriveKey(secret, clientNonce, []byte("drill early data"), 32)
+}
+
+// Key of a resumed session, fresh even if the client's nonce is replayed
+func DeriveResumedKey(secret, clientNonce, serverNonce []byte) []byte {
+	salt := append(append([]byte{}, clientNonce...), serverNonce...)
+
+	return xcrypto.DeriveKey(secret, salt, []byte("drill resumed key"), 32)
+}
+
+//
+// What a ticket carries, sealed so only the server can read it
+//
+type ResumeState struct {
+	User 		string
+	Suite 		int
+	Secret 		[]byte
+	Issued 		time.Time
+}
+
+//
+// Keys sealing the tickets, stateless on the server side. The key rotates on
+// every ticket lifetime, the previous one still opens the tickets issued
+// before the rotation. Safe for concurrent use.
+//
+type TicketKeys struct {
+	mu 			sync.Mutex
+	cur 		xcrypto.XCipher
+	prev 		*xcrypto.XCipher
+	rotated 	time.Time
+}
+
+func NewTicketKeys() *TicketKeys {
+	return &TicketKeys {
+		cur: xcrypto.NewXCipher(xcrypto.RandomKey(32)),
+		rotated: time.Now(),
+	}
+}
+
+func (tk *TicketKeys) rotate() {
+	if time.Since(tk.rotated) < ticketLifetime {
+		return
+	}
+
+	prev := tk.cur
+	tk.prev = &prev
+	tk.cur = xcrypto.NewXCipher(xcrypto.RandomKey(32))
+	tk.rotated = time.Now()
+}
+
+// Ticket layout: Issued(8) + Suite(1) + Secret(32) + User
+func (tk *TicketKeys) Seal(state ResumeState) []byte {
+	plaintext := make([]byte, 0, 8 + 1 + 32 + len(state.User))
+	plaintext, _ = binary.Append(
+		plaintext,
+		binary.BigEndian,
+		uint64(state.Issued.Unix()),
+	)
+	plaintext = append(plaintext, byte(state.Suite))
+	plaintext = append(plaintext, state.Secret...)
+	plaintext = append(plaintext, []byte(state.User)...)
+
+	tk.mu.Lock()
+	defer tk.mu.Unlock()
+
+	tk.rotate()
+
+	return tk.cur.Encrypt(plaintext)
+}
+
+func (tk *TicketKeys) Open(ticket []byte) (ResumeState, error) {
+	tk.mu.Lock()
+	tk.rotate()
+
+	plaintext, err := tk.cur.Decrypt(ticket)
+	if err != nil && tk.prev != nil {
+		plaintext, err = tk.prev.Decrypt(ticket)
+	}
+	tk.mu.Unlock()
+
+	if err != nil {
+		return ResumeState{}, fmt.Errorf("can't open resumption ticket")
+	}
+
+	if len(plaintext) < 8 + 1 + 32 {
+		return ResumeState{}, fmt.Errorf("malform resumption ticket")
+	}
+
+	state := ResumeState {
+		User: string(plaintext[41:]),
+		Suite: int(plaintext[8]),
+		Secret: plaintext[9:41],
+		Issued: time.Unix(int64(binary.BigEndian.Uint64(plaintext[0:8])), 0),
+	}
+
+	if time.Since(state.Issued) > ticketLifetime {
+		return ResumeState{}, fmt.Errorf("resumption ticket expired")
+	}
+
+	return state, nil
+}
+
+//
+// The ticket a client keeps for its next session. A ticket is used once,
+// whether the resumption works or not.
+//
+type ClientTicket struct {
+	Ticket 		[]byte
+	Suite 		int
+	Secret 		[]byte
+	Received 	time.Time
+}
+
+// Tickets live in the client's memory only, a restarted client comes up with
+// a full handshake
+type ClientTickets struct {
+	mu 			sync.Mutex
+	ticket 		*ClientTicket
+}
+
+func NewClientTickets() *ClientTickets {
+	return &ClientTickets{}
+}
+
+func (ct *ClientTickets) Save(ticket ClientTicket) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	ct.ticket = &ticket
+}
+
+// Tell if there is a ticket still worth trying
+func (ct *ClientTickets) Ready() bool {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	return ct.ticket != nil && time.Since(ct.ticket.Received) < ticketLifetime
+}
+
+func (ct *ClientTickets) Take() (ClientTicket, bool) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	ticket := ct.ticket
+	ct.ticket = nil
+
+	if ticket == nil || time.Since(ticket.Received) >= ticketLifetime {
+		return ClientTicket{}, false
+	}
+
+	return *ticket, true
+}
+
+//
+// RESUME payload, padded like an INIT:
+// TicketSize(2) + Ticket + Nonce(32) + EarlySize(2) + Early
+//
+// The early data is a datagram sealed with the early key. Only CONNs may ride
+// in it. The server remembers the whole payload for as long as it would pass
+// the freshness check, so a replayed first flight can't open streams twice.
+//
+func EncodeResume(
+	protocol string,
+	ticket ClientTicket,
+	nonce []byte,
+	early []Packet,
+) []byte {
+	payload := make([]byte, 0, 1200)
+	payload, _ = binary.Append(
+		payload,
+		binary.BigEndian,
+		uint16(len(ticket.Ticket)),
+	)
+	payload = append(payload, ticket.Ticket...)
+	payload = append(payload, nonce...)
+
+	sealed := []byte{}
+
+	if len(early) > 0 {
+		key := DeriveEarlyKey(ticket.Secret, nonce)
+		obfs := obfuscate.BuildSuiteObfuscator(protocol, ticket.Suite, key)
+		sealed = obfs.Encode(EncodeDatagram(1, early))
+	}
+
+	// Early data that doesn't fit is sent once the session is up
+	if len(payload) + 2 + len(sealed) > 1200 {
+		sealed = []byte{}
+	}
+
+	payload, _ = binary.Append(payload, binary.BigEndian, uint16(len(sealed)))
+	payload = append(payload, sealed...)
+
+	return payload
+}
+
+func ParseResume(payload []byte) ([]byte, []byte, []byte, error) {
+	if len(payload) < 2 {
+		return nil, nil, nil, fmt.Errorf("not enough bytes of ticket size")
+	}
+
+	size := int(binary.BigEndian.Uint16(payload[0:2]))
+	payload = payload[2:]
+
+	if len(payload) < size + RESUME_NONCE_SIZE + 2 {
+		return nil, nil, nil, fmt.Errorf("not enough bytes of resumption")
+	}
+
+	ticket := payload[:size]
+	nonce := payload[size:size+RESUME_NONCE_SIZE]
+	payload = payload[size+RESUME_NONCE_SIZE:]
+
+	earlySize := int(binary.BigEndian.Uint16(payload[0:2]))
+	payload = payload[2:]
+
+	if len(payload) < earlySize {
+		return nil, nil, nil, fmt.Errorf("not enough bytes of early data")
+	}
+
+	return ticket, nonce, payload[:earlySize], nil
+}
+
+// Open the early data of a resumption, keeping only what 0-RTT may do
+func openEarly(
+	protocol string,
+	state ResumeState,
+	nonce []byte,
+	sealed []byte,
+) ([]Packet, error) {
+	if len(sealed) == 0 {
+		return nil, nil
+	}
+
+	key := DeriveEarlyKey(state.Secret, nonce)
+	obfs := obfuscate.BuildSuiteObfuscator(protocol, state.Suite, key)
+
+	decoded, err := obfs.Decode(sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	_, pkts, err := ParseDatagram(decoded)
+	if err != nil {
+		return nil, err
+	}
+
+	early := []Packet{}
+
+	for _, pkt := range pkts {
+		if pkt.Method != CONN || len(early) >= maxEarlyStreams {
+			return nil, fmt.Errorf(
+				"early data may only open %v streams",
+				maxEarlyStreams,
+			)
+		}
+
+		early = append(early, pkt)
+	}
+
+	return early, nil
+}
@@ -0,0 +1,378 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"sync"
+	"context"
+)
+
+//
+// Priority classes, a lower class is always served before a higher one. The
+// session control packets (PING, CONN, OK...) are served before all of them.
+//
+const (
+	ClassInteractive int = iota
+	ClassNormal
+	ClassBulk
+)
+
+const (
+	// Bytes a stream may send per round for each unit of its weight
+	schedQuantum int = 1500
+
+	// Packets queued per stream before its sender blocks
+	schedQueueLimit int = 1024
+)
+
+func ParseSchedClass(name string) (int, error) {
+	switch name {
+	case "interactive":
+		return ClassInteractive, nil
+	case "normal", "":
+		return ClassNormal, nil
+	case "bulk":
+		return ClassBulk, nil
+	default:
+		return 0, fmt.Errorf("unknown scheduling class %q", name)
+	}
+}
+
+//
+// Assign streams to a class and a weight by their destination
+//
+type SchedRule struct {
+	Dst 		string
+	Class 		int
+	Weight 		int
+}
+
+type SchedPolicy struct {
+	Rules 		[]SchedRule
+}
+
+// The dst is a "host:port" pattern, both parts take shell globs such as
+// "*:22" or "*.example.com:*".
+func (sp *SchedPolicy) AddRule(dst, class string, weight int) error {
+	if err := validDstPattern(dst); err != nil {
+		return fmt.Errorf("malform scheduling rule. %s", err)
+	}
+
+	cls, err := ParseSchedClass(class)
+	if err != nil {
+		return err
+	}
+
+	if weight <= 0 {
+		weight = 1
+	}
+
+	sp.Rules = append(sp.Rules, SchedRule { dst, cls, weight })
+
+	return nil
+}
+
+// First matched rule wins, unmatched streams are normal with weight 1
+func (sp *SchedPolicy) Classify(dst string) (int, int) {
+	for _, rule := range sp.Rules {
+		if matchDst(rule.Dst, dst) {
+			return rule.Class, rule.Weight
+		}
+	}
+
+	return ClassNormal, 1
+}
+
+func validDstPattern(pattern string) error {
+	host, port, err := net.SplitHostPort(pattern)
+	if err != nil {
+		return fmt.Errorf("dst %q. %s", pattern, err)
+	}
+
+	if _, err := path.Match(host, ""); err != nil {
+		return fmt.Errorf("host %q. %s", host, err)
+	}
+
+	if _, err := path.Match(port, ""); err != nil {
+		return fmt.Errorf("port %q. %s", port, err)
+	}
+
+	return nil
+}
+
+// Match a "host:port" destination against a validated pattern
+func matchDst(pattern, dst string) bool {
+	host, port, err := net.SplitHostPort(dst)
+	if err != nil {
+		return false
+	}
+
+	patternHost, patternPort, _ := net.SplitHostPort(pattern)
+
+	if ok, _ := path.Match(patternHost, host); !ok {
+		return false
+	}
+
+	ok, _ := path.Match(patternPort, port)
+
+	return ok
+}
+
+//
+// Per-session scheduler sitting between the stream tasks and the obfuscation
+// sender. Classes are served by strict priority, the streams within a class
+// by deficit round robin weighted by their weight.
+//
+type Scheduler struct {
+	mu 			sync.Mutex
+	cond 		*sync.Cond
+	policy 		SchedPolicy
+	classes 	map[int]*schedClass
+	order 		[]int
+	interactive map[uint64]bool
+	wake 		chan struct{}
+	closed 		bool
+}
+
+type schedClass struct {
+	queues 		[]*schedQueue
+	cur 		int
+}
+
+type schedQueue struct {
+	id 			uint64
+	packets 	[]Packet
+	weight 		int
+	deficit 	int
+	fresh 		bool
+	done 		bool
+}
+
+func NewScheduler(policy SchedPolicy) *Scheduler {
+	s := &Scheduler {
+		policy: policy,
+		classes: make(map[int]*schedClass),
+		order: []int{ ClassInteractive, ClassNormal, ClassBulk },
+		interactive: make(map[uint64]bool),
+		wake: make(chan struct{}, 1),
+	}
+
+	s.cond = sync.NewCond(&s.mu)
+
+	for _, class := range s.order {
+		s.classes[class] = &schedClass{}
+	}
+
+	return s
+}
+
+// Serve the control channel and every opened stream to outCh until the
+// context is done
+func (s *Scheduler) Run(
+	ctx context.Context,
+	ctrlCh <-chan Packet,
+	outCh chan<-Packet,
+) {
+	defer func() {
+		s.mu.Lock()
+		s.closed = true
+		s.mu.Unlock()
+		s.cond.Broadcast()
+	}()
+
+	for {
+		var pkt Packet
+
+		// Control packets go ahead of every stream
+		select {
+		case pkt = <-ctrlCh:
+			break
+		default:
+			var ok bool
+
+			if pkt, ok = s.next(); ok {
+				break
+			}
+
+			select {
+			case pkt = <-ctrlCh:
+				break
+			case <-s.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case outCh <- pkt:
+			break
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Open a queue for the stream of the given local id and destination. The
+// caller closes the returned channel once nothing is sent to it anymore, the
+// packets left in the queue are still delivered.
+func (s *Scheduler) Open(ctx context.Context, id uint64, dst string) chan Packet {
+	class, weight := s.policy.Classify(dst)
+	ch := make(chan Packet, 64)
+
+	s.feed(ctx, ch, s.add(id, class, weight))
+
+	return ch
+}
+
+// Tell if packets are latency critical, i.e. any of them is a control packet
+// or belongs to an interactive stream
+func (s *Scheduler) Urgent(pkts []Packet) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, pkt := range pkts {
+		switch pkt.Method {
+		case FWD, ACK, SENDFIN, RECVFIN:
+			if s.interactive[pkt.Src] {
+				return true
+			}
+			break
+		default:
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *Scheduler) add(id uint64, class, weight int) *schedQueue {
+	q := &schedQueue {
+		id: id,
+		weight: weight,
+		fresh: true,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cls := s.classes[class]
+	cls.queues = append(cls.queues, q)
+
+	if class == ClassInteractive {
+		s.interactive[id] = true
+	}
+
+	return q
+}
+
+// Move the packets from a channel into its queue, block the sender when the
+// queue is full
+func (s *Scheduler) feed(ctx context.Context, ch <-chan Packet, q *schedQueue) {
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			q.done = true
+			s.mu.Unlock()
+			s.notify()
+		}()
+
+		for {
+			var pkt Packet
+			var ok bool
+
+			select {
+			case pkt, ok = <-ch:
+				break
+			case <-ctx.Done():
+				return
+			}
+
+			if !ok {
+				return
+			}
+
+			s.mu.Lock()
+			for len(q.packets) >= schedQueueLimit && !s.closed {
+				s.cond.Wait()
+			}
+
+			if s.closed {
+				s.mu.Unlock()
+				return
+			}
+
+			q.packets = append(q.packets, pkt)
+			s.mu.Unlock()
+			s.notify()
+		}
+	}()
+}
+
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+		break
+	default:
+		break
+	}
+}
+
+func (s *Scheduler) next() (Packet, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, class := range s.order {
+		if pkt, ok := s.classes[class].next(s.interactive); ok {
+			s.cond.Broadcast()
+			return pkt, true
+		}
+	}
+
+	return Packet{}, false
+}
+
+func (c *schedClass) next(interactive map[uint64]bool) (Packet, bool) {
+	// Every non-empty queue can send at least a packet on its fresh turn, so
+	// two passes are enough to find one
+	for tries := 0; tries < 2*len(c.queues) && len(c.queues) > 0; tries++ {
+		c.cur = c.cur % len(c.queues)
+		q := c.queues[c.cur]
+
+		if len(q.packets) == 0 {
+			q.deficit = 0
+			q.fresh = true
+
+			// Drop the queues of closed streams once drained
+			if q.done {
+				c.queues = append(c.queues[:c.cur], c.queues[c.cur+1:]...)
+				delete(interactive, q.id)
+				continue
+			}
+
+			c.cur += 1
+			continue
+		}
+
+		if q.fresh {
+			q.deficit += schedQuantum * q.weight
+			q.fresh = false
+		}
+
+		size := FrameSize(q.packets[0])
+
+		if size <= q.deficit {
+			pkt := q.packets[0]
+			q.packets = q.packets[1:]
+			q.deficit -= size
+			return pkt, true
+		}
+
+		// Out of credit, leave the rest to the next round
+		q.fresh = true
+		c.cur += 1
+	}
+
+	return Packet{}, false
+}
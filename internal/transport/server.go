@@ -2,48 +2,125 @@ package transport
 
 import (
 	"log"
+	"context"
+	"errors"
 	"fmt"
 	"time"
 	"net"
 	"sync"
+	"slices"
 	"drill/internal/obfuscate"
-	"drill/pkg/netio"
 	"drill/pkg/xcrypto"
+	"drill/pkg/netio"
 )
 
 type ServerTransport struct {
 	laddr 		*net.UDPAddr
 	protocol 	string
-	pkey  		[]byte
+	users 		[]*User
+	identity 	Identity
+	secret 		[]byte
+	inits 		*ReplayCache
+	tickets 	*TicketKeys
+	limits 		InitLimits
+	limiter 	*InitLimiter
+	decoy 		*Decoy
+	handshake 	int
+	suites 		[]int
+	timeouts 	Timeouts
+	policy 		SchedPolicy
+	mtu 		int
+	multipath 	Multipath
+	hopping 	Hopping
+	rekey 		Rekey
+	shaping 	Shaping
 	wg    		*sync.WaitGroup
 }
 
 func NewServerTransport(
 	laddr *net.UDPAddr,
 	protocol string,
-	pkey []byte,
+	users []*User,
+	identity Identity,
+	handshake int,
+	suites []int,
+	timeouts Timeouts,
+	policy SchedPolicy,
+	mtu int,
+	multipath Multipath,
+	hopping Hopping,
+	rekey Rekey,
+	limits InitLimits,
+	decoy *net.UDPAddr,
+	shaping Shaping,
 	wg *sync.WaitGroup,
 ) ServerTransport {
 	return ServerTransport {
 		laddr,
 		protocol,
-		pkey,
+		users,
+		identity,
+		// Retry tokens are checked before the user is known
+		xcrypto.RandomKey(32),
+		NewReplayCache(),
+		NewTicketKeys(),
+		limits,
+		NewInitLimiter(limits),
+		NewDecoy(decoy, limits.Amplification, maxDecoyRelays),
+		handshake,
+		suites,
+		timeouts,
+		policy,
+		mtu,
+		multipath,
+		hopping,
+		rekey,
+		shaping,
 		wg,
 	}
 }
 
 func (st *ServerTransport) Run() {
-	conn, err := net.ListenUDP("udp", st.laddr)
+	laddrs := append([]*net.UDPAddr{ st.laddr }, st.multipath.Remotes...)
+	conns := []*net.UDPConn{}
 
-	// Return if something goes wrong during binding of address
-	if err != nil {
-		log.Printf("Error listen on UDP %s: %s\n", st.laddr, err)
-		st.wg.Done()
-		return
+	// Clients may hop to any port of the range on each address
+	hops := []*net.UDPAddr{}
+	for _, laddr := range laddrs {
+		hops = append(hops, st.hopping.Addrs(laddr)...)
+	}
+	laddrs = append(laddrs, hops...)
+
+	for _, laddr := range laddrs {
+		conn, err := net.ListenUDP("udp", laddr)
+
+		// Return if something goes wrong during binding of address
+		if err != nil {
+			log.Printf("Error listen on UDP %s: %s\n", laddr, err)
+
+			for _, conn := range conns {
+				conn.Close()
+			}
+
+			st.wg.Done()
+			return
+		}
+
+		conns = append(conns, conn)
+	}
+
+	// Sessions are shared by all the addresses, a client may use several
+	sessions := NewSessions(st.multipath.Mode, st.multipath.ProbeInterval)
+
+	for _, conn := range conns[1:] {
+		go st.serverListen(conn, sessions)
 	}
 
+	st.serverListen(conns[0], sessions)
+}
+
+func (st *ServerTransport) serverListen(conn *net.UDPConn, sessions *Sessions) {
 	// Receive the ingress UDP packet
-	sessions := NewSessions()
 	buf := make([]byte, 65535)
 
 	for {
@@ -53,26 +130,22 @@ func (st *ServerTransport) Run() {
 			continue
 		}
 
-		ch, exists := sessions.Get(raddr)
-
-		if !exists && n < 1200 {
-			continue
-		}
+		sess, path, exists := sessions.Get(conn, raddr)
 
 		// Needs to deep copy, otherwise memory corruption
 		data := make([]byte, 0, n)
 		data = append(data, buf[:n]...)
 
-		if !exists && n >= 1200 {
-			pkey := make([]byte, 0, 32)
-			pkey = append(pkey, st.pkey...)
-			go serverHandle(conn, raddr, sessions, st.protocol, pkey, data)
+		if !exists {
+			st.serverFirstFlight(conn, raddr, sessions, data)
 			continue
 		}
 
-		// Set a time limit for the channel-sending operation. 
+		path.Budget().OnRecv(n)
+
+		// Set a time limit for the channel-sending operation.
 		select {
-		case ch<-data:
+		case sess.RecvCh <- Inbound { data, path }:
 			break
 		case <-time.After(200*time.Millisecond):
 			break
@@ -80,222 +153,738 @@ func (st *ServerTransport) Run() {
 	}
 }
 
-func serverHandle(
+//
+// The first datagrams of an address leave no state behind until a session is
+// worth it: the address proved it receives our datagrams by echoing a retry
+// token in front of its INIT or JOIN, or doesn't need to.
+//
+func (st *ServerTransport) serverFirstFlight(
 	conn *net.UDPConn,
 	raddr *net.UDPAddr,
 	sessions *Sessions,
-	protocol string,
-	pkey0 []byte,
-	initBytes []byte,
+	data []byte,
 ) {
-	recvCh, cid := sessions.Create(raddr)
-	sendCh := make(chan []byte, 65535)
+	// Over the rate whatever it is, dropped rather than decoyed so a flood
+	// of spoofed sources doesn't go through to the decoy either
+	if !st.limiter.Allow(raddr.IP) {
+		return
+	}
+
+	// Too small to be a first datagram
+	if len(data) < 1200 {
+		st.decoy.Forward(conn, raddr, data)
+		return
+	}
+
+	raw := data
+	validated := false
+
+	size, ok := ValidateRetryToken(data, raddr.IP, st.secret)
+	if ok && len(data) > size {
+		data, validated = data[size:], true
+	}
+
+	// Nothing tells a prober apart from the decoy's own clients, no matter
+	// what fails
+	user, initPkt, err := serverDecodeInit(st.users, data)
+	if err != nil {
+		st.decoy.Forward(conn, raddr, raw)
+		return
+	}
+
+	// A genuine INIT, JOIN or RESUME carries a fresh ephemeral key or nonce,
+	// so the same payload twice is a replay. It's only remembered once no
+	// retry is needed, the INIT comes again behind the token, and for as long
+	// as it passes the freshness check.
+	expires := initPkt.Created.Add(st.limits.Skew)
+
+	if st.inits.Contains(initPkt.Payload) {
+		log.Printf("Replayed first packet of %s from %s\n", user, raddr)
+		st.decoy.Forward(conn, raddr, raw)
+		return
+	}
+
+	// Stamped by the client's clock, which may be off ours. The client is
+	// told our time and comes again with another flight.
+	stale := CheckFreshness(initPkt.Created, 0, st.limits.Skew)
+
+	// A JOIN always proves its address, the session traffic moves to it. A
+	// RESUME is vouched for by its ticket. A flight out of time proves its
+	// address too, our time only goes to an address that echoed a token.
+	needRetry := initPkt.Method == JOIN ||
+		(initPkt.Method == INIT && st.limiter.NeedRetry()) ||
+		stale != nil
+
+	if needRetry && !validated {
+		// Way smaller than the first datagram, no amplification
+		token := NewRetryToken(raddr.IP, st.secret, st.shaping)
+		st.serverSend(conn, raddr, token, "retry token")
+		return
+	}
 
-	go serverSocketSend(conn, raddr, sendCh)
+	// Told our time once, its stamp is past the freshness window already so
+	// it's remembered from now on. A JOIN comes from a session that got the
+	// time right already.
+	if stale != nil {
+		log.Printf("First packet of %s from %s out of time. %s\n", user, raddr, stale)
+
+		seen := st.inits.Seen(initPkt.Payload, time.Now().Add(st.limits.Skew))
+		if seen || initPkt.Method == JOIN {
+			st.decoy.Forward(conn, raddr, raw)
+			return
+		}
 
-	if err := serverRetry(sendCh, recvCh, raddr, pkey0); err != nil {
-		log.Println(err)
-		sessions.Delete(raddr)
+		st.serverSkew(conn, raddr, user, initPkt)
 		return
 	}
 
-	pkey2 := xcrypto.RandomKey(32) 
+	if st.inits.Seen(initPkt.Payload, expires) {
+		log.Printf("Replayed first packet of %s from %s\n", user, raddr)
+		st.decoy.Forward(conn, raddr, raw)
+		return
+	}
 
-	if err := serverAuth(
-		sendCh, 
-		recvCh, 
-		protocol, 
-		pkey0, 
-		pkey2, 
-		cid, 
-		initBytes,
-	); err != nil {
-		log.Println(err)
-		sessions.Delete(raddr)
+	// A new path of an existing session rather than a new session
+	if initPkt.Method == JOIN {
+		if err := serverJoin(sessions, conn, raddr, user, initPkt); err != nil {
+			log.Println(err)
+		}
 		return
 	}
 
+	budget := NewAmpBudget(st.limits.Amplification, len(data), validated)
+
+	go st.serverHandle(conn, raddr, sessions, user, initPkt, data, budget)
+}
+
+// Tell the client our time, answering its flight. Way smaller than the flight,
+// no amplification.
+func (st *ServerTransport) serverSkew(
+	conn *net.UDPConn,
+	raddr *net.UDPAddr,
+	user *User,
+	flight Packet,
+) {
+	obfs := obfuscate.BuildObfuscator(handshakeProtocol, user.Pkey)
+	pkt := NewSkewPacket(flight.Payload)
+
+	st.serverSend(conn, raddr, obfs.Encode(st.shaping.Pad(pkt.AsBytes())), "time")
+}
+
+// Answer a first datagram without a session, after the shaping's delay. The
+// listening loop doesn't wait for it.
+func (st *ServerTransport) serverSend(
+	conn *net.UDPConn,
+	raddr *net.UDPAddr,
+	data []byte,
+	what string,
+) {
+	time.AfterFunc(st.shaping.Delay(), func() {
+		if err := netio.WriteUDPAddr(conn, raddr, data); err != nil {
+			log.Printf("Error send %s to %s. %s\n", what, raddr, err)
+		}
+	})
+}
+
+func (st *ServerTransport) serverHandle(
+	conn *net.UDPConn,
+	raddr *net.UDPAddr,
+	sessions *Sessions,
+	user *User,
+	initPkt Packet,
+	initData []byte,
+	budget *AmpBudget,
+) {
+	protocol := st.protocol
+	timeouts := st.timeouts
+
+	// Many pending handshakes switch the retry exchange on
+	done := st.limiter.Begin()
+	defer done()
+
+	sess := sessions.Create(conn, raddr)
+	recvCh, cid := sess.RecvCh, sess.Cid
+	sess.Paths.All()[0].Limit(budget)
+	sendCh := make(chan Outbound, 65535)
+
+	// Every goroutine of the session exits once the session is gone
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer sessions.Delete(sess)
+
+	go serverSocketSend(ctx, sess.Paths, sendCh)
+
+	// The client repeats its first datagram until it gets our answer
+	hs := NewHandshakeState(StepAuth, cid, timeouts.Handshake, st.shaping)
+	hs.Answer(initData)
+
+	var keys SessionKeys
+	var early []Packet
+	var err error
+
+	if initPkt.Method == RESUME {
+		// The ticket vouches for the client, no round trip needed
+		keys, early, err = serverResume(
+			sendCh,
+			hs,
+			protocol,
+			st.tickets,
+			st.suites,
+			user,
+			initPkt,
+		)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+	} else {
+		keys, err = serverAuth(
+			sendCh,
+			recvCh,
+			hs,
+			st.handshake,
+			st.identity,
+			st.suites,
+			user.Pkey,
+			initPkt,
+		)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		// The OK confirmation proves the client got our AUTH
+		budget.Validate()
+	}
+
+	pkey2 := keys.Key
+	codec := NewDatagramCodec(protocol, keys.Suite, pkey2, st.rekey, false)
+
+	sess.Paths.All()[0].Validate()
+	sessions.Establish(sess, user, pkey2, codec)
+	done()
+	if initPkt.Method == RESUME {
+		log.Printf("Session %v of %s resumed from %s\n", cid, user, raddr)
+	} else {
+		log.Printf("Session %v of %s from %s\n", cid, user, raddr)
+	}
+
 	//
 	// Multiplexing and Forwarding
 	//
 	obfsCh := make(chan Packet, 65535)
+	schedCh := make(chan Packet, 32)
+	sched := NewScheduler(st.policy)
+
+	go sched.Run(ctx, obfsCh, schedCh)
 	go serverObfsSend(
-		obfsCh,
+		ctx,
+		schedCh,
 		sendCh,
-		protocol,
-		pkey2,
+		sched,
+		codec,
+		st.mtu,
 	)
+	go ProbePaths(
+		ctx,
+		sess.Paths,
+		sendCh,
+		codec,
+		cid,
+		st.multipath.ProbeInterval,
+		false,
+	)
+	go serverReapPaths(ctx, sessions, sess, timeouts.SessionIdle)
+	go serverIssueTickets(ctx, obfsCh, st.tickets, user, keys, cid)
 
-	obfs := obfuscate.BuildObfuscator(protocol, pkey2)
 	endpoints := NewEndpoints()
 
+	// Streams opened by the first flight of a resumption
+	for _, pkt := range early {
+		serverDispatch(
+			ctx,
+			obfsCh,
+			sched,
+			endpoints,
+			cid,
+			user,
+			timeouts,
+			pkt,
+		)
+	}
+	idle := NewIdleTimer(timeouts.SessionIdle)
+	idleCh := idle.Watch(ctx)
+
 	for {
-		data := <-recvCh
+		var in Inbound
 
-		decoded, err := obfs.Decode(data)
-		if err != nil {
-			log.Println(err)
+		select {
+		case in = <-recvCh:
+			break
+		case <-idleCh:
+			log.Printf("Session %v of %s idle, closed\n", cid, user)
+			return
+		}
+
+		pkts, err := codec.Open(in.Data)
+
+		// The redundant copy of a datagram already handled, or a replay
+		if errors.Is(err, ErrReplay) {
+			in.Path.Touch()
+			continue
+		}
+
+		// The client didn't get our AUTH and repeats its first datagram
+		if err != nil && hs.Repeat(in.Data) {
 			continue
 		}
 
-		pkt, err := ParsePacket(decoded)
 		if err != nil {
 			log.Println(err)
 			continue
 		}
 
-		// 
-		// Connect
-		//
-		if pkt.Method == CONN {
-			ch, localId := endpoints.Create()
-			go serverConn(
+		// Only a client that got our AUTH seals with the session key
+		idle.Touch()
+		in.Path.Touch()
+		in.Path.Budget().Validate()
+
+		for _, pkt := range pkts {
+			//
+			// Path probes
+			//
+			if pkt.Method == PING {
+				replyProbe(sendCh, codec, in.Path, pkt)
+				continue
+			}
+
+			if pkt.Method == PONG {
+				in.Path.OnPong(pkt.Seq)
+				continue
+			}
+
+			serverDispatch(
+				ctx,
 				obfsCh,
-				ch, 
-				endpoints, 
+				sched,
+				endpoints,
 				cid,
-				localId, 
+				user,
+				timeouts,
 				pkt,
 			)
-			continue
 		}
+	}
+}
 
-		ch, exists := endpoints.Get(pkt.Dst)
+// Hand a packet of an established session to where it belongs
+func serverDispatch(
+	ctx context.Context,
+	obfsCh chan<-Packet,
+	sched *Scheduler,
+	endpoints *Endpoints,
+	cid uint64,
+	user *User,
+	timeouts Timeouts,
+	pkt Packet,
+) {
+	//
+	// Connect
+	//
+	if pkt.Method == CONN {
+		ch, localId := endpoints.Create()
+		go serverConn(
+			ctx,
+			obfsCh,
+			sched,
+			ch,
+			endpoints,
+			cid,
+			localId,
+			user,
+			timeouts.StreamIdle,
+			pkt,
+		)
+		return
+	}
 
-		if !exists {
-			continue
+	ch, exists := endpoints.Get(pkt.Dst)
+
+	if !exists {
+		rejectStaleStream(obfsCh, pkt)
+		return
+	}
+
+	select {
+	case ch <- pkt:
+		break
+	case <-time.After(200*time.Millisecond):
+		break
+	}
+}
+
+// Datagrams over the amplification budget of an unvalidated address are held
+// back, in order, until the client is heard again or validates the address
+func serverSocketSend(
+	ctx context.Context,
+	paths *PathSet,
+	ch <-chan Outbound,
+) {
+	held := []Outbound{}
+
+	for {
+		var retry <-chan time.Time
+		if len(held) > 0 {
+			retry = time.After(ampRetryInterval)
 		}
 
 		select {
-		case ch <- pkt:
+		case out := <-ch:
+			if len(held) < maxHeldDatagrams {
+				held = append(held, out)
+			}
 			break
-		case <-time.After(200*time.Millisecond):
+		case <-retry:
 			break
+		case <-ctx.Done():
+			return
+		}
+
+		for len(held) > 0 {
+			err := paths.Write(held[0])
+			if errors.Is(err, ErrAmplification) {
+				break
+			}
+
+			held = held[1:]
 		}
 	}
 }
 
-func serverSocketSend(conn *net.UDPConn, raddr *net.UDPAddr, ch <-chan []byte) {
+func serverObfsSend(
+	ctx context.Context,
+	recvCh <-chan Packet,
+	sendCh chan<-Outbound,
+	sched *Scheduler,
+	codec *DatagramCodec,
+	mtu int,
+) {
+	packer := NewFramePacker(recvCh, mtu - codec.Overhead())
+
 	for {
-		data := <-ch
-		if err := netio.WriteUDPAddr(conn, raddr, data); err != nil {
-			continue
+		pkts, ok := packer.Next(ctx)
+		if !ok {
+			return
+		}
+
+		sendCh <- Outbound {
+			Data: codec.Seal(pkts),
+			Urgent: sched.Urgent(pkts),
 		}
 	}
 }
 
-func serverObfsSend(
-	recvCh <-chan Packet,
-	sendCh chan<-[]byte, 
-	protocol string, 
-	pkey2 []byte,
+// The first datagram of an address is an INIT, a JOIN or a RESUME, encrypted
+// with the key of one of the users
+func serverDecodeInit(
+	users []*User,
+	initBytes []byte,
+) (*User, Packet, error) {
+	user, decoded, err := identifyUser(users, handshakeProtocol, initBytes)
+	if err != nil {
+		return nil, Packet{}, err
+	}
+
+	pkt, err := ParsePacket(decoded)
+	if err != nil {
+		return nil, Packet{}, err
+	}
+
+	if pkt.Method != INIT && pkt.Method != JOIN && pkt.Method != RESUME {
+		return nil, Packet{}, fmt.Errorf(
+			"%w, unexpected %s as first packet from %s",
+			ErrHandshake,
+			MethodName(pkt.Method),
+			user,
+		)
+	}
+
+	// Only a JOIN belongs to a connection already
+	if (pkt.Method == JOIN) != (pkt.ConnId != 0) {
+		return nil, Packet{}, fmt.Errorf(
+			"%w, %s of connection %v from %s",
+			ErrHandshake,
+			MethodName(pkt.Method),
+			pkt.ConnId,
+			user,
+		)
+	}
+
+	return user, pkt, nil
+}
+
+// Resume a session from a ticket, answer with our nonce and a proof we could
+// open the ticket. Gives the session keys and the streams 0-RTT may open.
+func serverResume(
+	sendCh chan<-Outbound,
+	hs *HandshakeState,
+	protocol string,
+	tickets *TicketKeys,
+	suites []int,
+	user *User,
+	resumePkt Packet,
+) (SessionKeys, []Packet, error) {
+	cid := hs.Cid()
+
+	ticket, nonce, sealed, err := ParseResume(resumePkt.Payload)
+	if err != nil {
+		return SessionKeys{}, nil, err
+	}
+
+	state, err := tickets.Open(ticket)
+	if err != nil {
+		return SessionKeys{}, nil, err
+	}
+
+	if state.User != user.Name {
+		return SessionKeys{}, nil, fmt.Errorf(
+			"ticket of %s used by %s",
+			state.User,
+			user,
+		)
+	}
+
+	if !slices.Contains(suites, state.Suite) {
+		return SessionKeys{}, nil, fmt.Errorf(
+			"ticket of %s has cipher suite %v, which isn't allowed anymore",
+			user,
+			state.Suite,
+		)
+	}
+
+	// Refused early data doesn't fail the resumption, the client sends it
+	// again once the session is up
+	accepted := byte(1)
+
+	early, err := openEarly(protocol, state, nonce, sealed)
+	if err != nil {
+		log.Printf("Early data of %s refused. %s\n", user, err)
+		early, accepted = nil, 0
+	}
+
+	serverNonce := xcrypto.RandomKey(RESUME_NONCE_SIZE)
+	key := DeriveResumedKey(state.Secret, nonce, serverNonce)
+	proof := NewResumeProof(state.Secret, nonce, serverNonce, []byte{ accepted })
+
+	payload := append([]byte{ accepted }, serverNonce...)
+	payload = append(payload, proof...)
+
+	obfs := obfuscate.BuildObfuscator(handshakeProtocol, user.Pkey)
+	hs.Send(sendCh, NewAuthPacket(cid, payload), obfs)
+	hs.Move(StepDone)
+
+	return SessionKeys { key, state.Suite }, early, nil
+}
+
+// Hand the client a ticket for its next session, and a fresh one before the
+// previous expires
+func serverIssueTickets(
+	ctx context.Context,
+	obfsCh chan<-Packet,
+	tickets *TicketKeys,
+	user *User,
+	keys SessionKeys,
+	cid uint64,
 ) {
-	obfs := obfuscate.BuildObfuscator(protocol, pkey2)
+	secret := DeriveResumptionSecret(keys.Key)
 
 	for {
-		pkt := <-recvCh
+		ticket := tickets.Seal(ResumeState {
+			User: user.Name,
+			Suite: keys.Suite,
+			Secret: secret,
+			Issued: time.Now(),
+		})
 
-		encoded := obfs.Encode(pkt.AsBytes())
+		select {
+		case obfsCh <- NewTicketPacket(cid, ticket):
+			break
+		case <-ctx.Done():
+			return
+		}
 
-		sendCh <-encoded
+		select {
+		case <-time.After(ticketReissue):
+			break
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
-func serverRetry(
-	sendCh chan<-[]byte, 
-	recvCh <-chan []byte, 
+func serverJoin(
+	sessions *Sessions,
+	conn *net.UDPConn,
 	raddr *net.UDPAddr,
-	pkey0 []byte,
+	user *User,
+	joinPkt Packet,
 ) error {
-	token := NewRetryToken(raddr.IP, pkey0)
+	sess, key, ok := sessions.Lookup(joinPkt.ConnId)
+	if !ok || sess.User != user {
+		return fmt.Errorf(
+			"%s can't join unknown session %v", 
+			user, 
+			joinPkt.ConnId,
+		)
+	}
 
-	sendCh <- token
+	if !ValidateJoinProof(joinPkt.Payload, key, joinPkt.ConnId) {
+		return fmt.Errorf("can't validate join proof of session %v", sess.Cid)
+	}
 
-	select {
-	case data :=<-recvCh:
-		if !ValidateRetryToken(data, raddr.IP, pkey0) {
-			return fmt.Errorf("can't validate retry token from client")
-		}
-		break
-	case <-time.After(2*time.Second):
-		return fmt.Errorf("timeout on receving retry token from client")
+	// The retry exchange already proved the client owns the address
+	path := sessions.Attach(sess, conn, raddr)
+	log.Printf("Session %v joined by path %s\n", sess.Cid, path)
+
+	// Let the client know the path is attached, the answer isn't tracked
+	ping := NewPingPacket(sess.Cid, 0)
+
+	return path.Write(sess.Codec.Seal([]Packet{ ping }))
+}
+
+// Detach the paths the client stopped using, e.g. after a port hop
+func serverReapPaths(
+	ctx context.Context,
+	sessions *Sessions,
+	sess *Session,
+	after time.Duration,
+) {
+	if after <= 0 {
+		return
 	}
 
-	return nil
+	for {
+		select {
+		case <-time.After(after):
+			break
+		case <-ctx.Done():
+			return
+		}
+
+		for _, path := range sess.Paths.All() {
+			if _, _, lastRecv := path.Stats(); time.Since(lastRecv) > after {
+				log.Printf("Session %v dropped path %s\n", sess.Cid, path)
+				sessions.Detach(sess, path)
+			}
+		}
+	}
 }
 
 func serverAuth(
-	sendCh chan<-[]byte, 
-	recvCh <-chan []byte, 
-	protocol string, 
-	pkey0, pkey2 []byte, 
-	cid uint64, 
-	initBytes []byte,
-) error {
+	sendCh chan<-Outbound,
+	recvCh <-chan Inbound,
+	hs *HandshakeState,
+	handshake int,
+	identity Identity,
+	suites []int,
+	pkey0 []byte,
+	initPkt Packet,
+) (SessionKeys, error) {
+	cid := hs.Cid()
+	hs.Record(initPkt.Payload)
+
 	//
-	// Get the pkey1 from the INIT packet from client.
+	// Pick a cipher suite among the offered ones, then run our part of the
+	// key agreement on the rest of the INIT payload from client
 	//
-	obfs := obfuscate.BuildObfuscator(protocol, pkey0)
-	pkey1 := make([]byte, 0, 32)
-	decoded, err := obfs.Decode(initBytes)
+	offered, token, err := parseSuites(initPkt.Payload)
 	if err != nil {
-		return err 
+		return SessionKeys{}, hs.wrap(err)
 	}
 
-	pkt, err := ParsePacket(decoded)
+	suite, err := pickSuite(suites, offered)
 	if err != nil {
-		return err
+		return SessionKeys{}, hs.wrap(err)
 	}
 
-	pkey1 = append(pkey1, pkt.Payload[0:32]...)
+	reply, pkey2, err := ServerKex(handshake, identity, pkey0, token)
+	if err != nil {
+		return SessionKeys{}, hs.wrap(err)
+	}
 
 	//
-	// Build a obfuscated packet (encrypted w/ pkey1)
-	// Send it to client
+	// Build a obfuscated packet (encrypted w/ PSK) carrying the picked suite
+	// and our part. Send it to client
 	//
-	obfs.SetPkey(pkey1)
+	obfs := obfuscate.BuildObfuscator(handshakeProtocol, pkey0)
 
-	pkt = NewAuthPacket(cid, pkey2)
-	encoded := obfs.Encode(pkt.AsBytes()) 
-	sendCh <- encoded
+	pkt := NewAuthPacket(cid, append([]byte{ byte(suite) }, reply...))
+	hs.Send(sendCh, pkt, obfs)
+	hs.Record(pkt.Payload)
 
 	//
-	// Recv a obfuscated packet that encrypted with pkey2
+	// Recv a obfuscated packet that encrypted with the confirm key of pkey2
+	// under the picked suite, which proves the client derived the same key.
+	// Its proof covers the INIT and the AUTH as the client saw them. The AUTH
+	// goes again meanwhile, the client answers it with the OK until we got
+	// it.
 	//
-	obfs.SetPkey(pkey2)
+	confirm := DeriveConfirmKey(pkey2)
+	obfs = obfuscate.BuildSuiteObfuscator(handshakeProtocol, suite, confirm)
+	transcript := hs.Transcript()
 
-	encoded = <-recvCh
-
-	decoded, err = obfs.Decode(encoded)
+	pkt, err = hs.Await(recvCh, obfs)
 	if err != nil {
-		return err
+		return SessionKeys{}, err
 	}
 
-	pkt, err = ParsePacket(decoded)
-	if err != nil {
-		return err
+	if !ValidateConfirmProof(pkt.Payload, pkey2, transcript...) {
+		return SessionKeys{}, hs.fail("confirmation doesn't match the transcript")
 	}
 
-	return nil
+	hs.Move(StepDone)
+
+	return SessionKeys { pkey2, suite }, nil
 }
 
 func serverConn(
-	sendCh chan<-Packet, 
-	recvCh <-chan Packet, 
-	endpoints *Endpoints, 
-	cid, localId uint64, 
+	ctx context.Context,
+	sendCh chan<-Packet,
+	sched *Scheduler,
+	recvCh <-chan Packet,
+	endpoints *Endpoints,
+	cid, localId uint64,
+	user *User,
+	idleTimeout time.Duration,
 	connPkt Packet,
 ) {
 	remoteId := connPkt.Src
 	host := string(connPkt.Payload)
+	defer endpoints.Delete(localId)
 
-	conn, err := net.Dial("tcp", host)
-	if err != nil {
+	refuse := func() {
 		errPkt := NewErrPacket(cid)
 		errPkt.Dst = remoteId
 		sendCh <- errPkt
-		endpoints.Delete(localId)
+	}
+
+	if !user.Allowed(host) {
+		refuse()
+		log.Printf("User %s isn't allowed to connect to %s\n", user, host)
+		return
+	}
+
+	if !user.OpenStream() {
+		refuse()
+		log.Printf("User %s is out of streams for %s\n", user, host)
+		return
+	}
+	defer user.CloseStream()
 
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		refuse()
 		log.Printf("Error connect to %s: %s\n", host, err)
 		return
 	}
@@ -305,17 +894,17 @@ func serverConn(
 	okPkt.Dst = remoteId
 	sendCh <- okPkt
 
-	syncCh := make(chan Packet, 65535)
-
-	var wg sync.WaitGroup
-	wg.Add(2)
-	//go SendTask(&wg, conn, sendCh, syncCh, cid, localId, remoteId)
-	go SendTask2(&wg, conn, sendCh, syncCh, cid, localId, remoteId)
-
-	go RecvTask(&wg, conn, sendCh, recvCh, syncCh, cid, localId, remoteId)
-	wg.Wait()
-
-	endpoints.Delete(localId)
-
-	return
+	streamCh := sched.Open(ctx, localId, host)
+	defer close(streamCh)
+
+	RunStream(
+		ctx,
+		conn,
+		streamCh,
+		recvCh,
+		cid,
+		localId,
+		remoteId,
+		idleTimeout,
+	)
 }
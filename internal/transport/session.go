@@ -1,21 +1,44 @@
 package transport
 
 import (
-	"fmt"
 	"net"
 	"sync"
+	"time"
 	"sync/atomic"
 )
 
+//
+// A server side session, reachable from every path that joined it
+//
+type Session struct {
+	Cid 		uint64
+	RecvCh 		chan Inbound
+	Paths 		*PathSet
+	User 		*User
+	Codec 		*DatagramCodec
+	key 		[]byte
+}
+
+type sessionPath struct {
+	sess 		*Session
+	path 		*Path
+}
+
 type Sessions struct {
 	mu 		sync.RWMutex
 	counter atomic.Uint64
-	sessions map[string]chan []byte
+	paths 	map[string]sessionPath
+	cids 	map[uint64]*Session
+	mode 	int
+	probe 	time.Duration
 }
 
-func NewSessions() *Sessions {
+func NewSessions(mode int, probeInterval time.Duration) *Sessions {
 	ss := &Sessions {
-		sessions: make(map[string]chan []byte),
+		paths: make(map[string]sessionPath),
+		cids: make(map[uint64]*Session),
+		mode: mode,
+		probe: probeInterval,
 	}
 
 	ss.counter.Store(1)
@@ -23,41 +46,112 @@ func NewSessions() *Sessions {
 	return ss
 }
 
-func (ss *Sessions) Create(addr *net.UDPAddr) (chan []byte, uint64) {
-	ch := make(chan []byte, 65535)
-	key := fmt.Sprintf("%s:%d", addr.IP.String(), addr.Port)
+func (ss *Sessions) Create(conn *net.UDPConn, addr *net.UDPAddr) *Session {
+	path := NewPath(conn, addr)
+	sess := &Session {
+		RecvCh: make(chan Inbound, 65535),
+		Paths: NewPathSet(ss.mode, ss.probe),
+	}
+	sess.Paths.Add(path)
 
 	ss.mu.Lock()
 	defer ss.mu.Unlock()
 
-	cid := ss.counter.Load()
+	sess.Cid = ss.counter.Load()
 	ss.counter.Add(1)
-	ss.sessions[key] = ch
+	ss.paths[pathKey(conn, addr)] = sessionPath { sess, path }
+
+	return sess
+}
+
+// Make a session joinable by its cid once its user and key are settled
+func (ss *Sessions) Establish(
+	sess *Session,
+	user *User,
+	key []byte,
+	codec *DatagramCodec,
+) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
 
-	return ch, cid
+	sess.User = user
+	sess.Codec = codec
+	sess.key = key
+	ss.cids[sess.Cid] = sess
 }
 
-func (ss *Sessions) Delete(addr *net.UDPAddr) {
-	key := fmt.Sprintf("%s:%d", addr.IP.String(), addr.Port)
+// Add a new path to an established session
+func (ss *Sessions) Attach(
+	sess *Session, 
+	conn *net.UDPConn, 
+	addr *net.UDPAddr,
+) *Path {
+	path := NewPath(conn, addr)
+	path.Validate()
+	sess.Paths.Add(path)
 
 	ss.mu.Lock()
 	defer ss.mu.Unlock()
 
-	if ch, exists := ss.sessions[key]; exists {
-		close(ch)
-		delete(ss.sessions, key)
-	}
+	ss.paths[pathKey(conn, addr)] = sessionPath { sess, path }
+
+	return path
 }
 
-func (ss *Sessions) Get(addr *net.UDPAddr) (chan []byte, bool) {
-	key := fmt.Sprintf("%s:%d", addr.IP.String(), addr.Port)
+// Remove a path from its session
+func (ss *Sessions) Detach(sess *Session, path *Path) {
+	sess.Paths.Remove(path)
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	key := pathKey(path.Conn, path.Addr)
 
+	if ss.paths[key].sess == sess {
+		delete(ss.paths, key)
+	}
+}
+
+func (ss *Sessions) Delete(sess *Session) {
 	ss.mu.Lock()
 	defer ss.mu.Unlock()
 
-	ch, ok := ss.sessions[key]
+	// The channel isn't closed since the receiving loop may still hand data
+	// to it, the session owner stops reading on its own context instead.
+	for key, sp := range ss.paths {
+		if sp.sess == sess {
+			delete(ss.paths, key)
+		}
+	}
+
+	if ss.cids[sess.Cid] == sess {
+		delete(ss.cids, sess.Cid)
+	}
+}
+
+func (ss *Sessions) Get(
+	conn *net.UDPConn, 
+	addr *net.UDPAddr,
+) (*Session, *Path, bool) {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+
+	sp, ok := ss.paths[pathKey(conn, addr)]
 	
-	return ch, ok
+	return sp.sess, sp.path, ok
+}
+
+// Find an established session and its key
+func (ss *Sessions) Lookup(cid uint64) (*Session, []byte, bool) {
+	ss.mu.RLock()
+	defer ss.mu.RUnlock()
+
+	sess, ok := ss.cids[cid]
+	if !ok {
+		return nil, nil, false
+	}
+
+	return sess, sess.key, true
 }
 
 type Endpoints struct {
@@ -93,10 +187,7 @@ func (ep *Endpoints) Delete(id uint64) {
 	ep.mu.Lock()
 	defer ep.mu.Unlock()
 
-	if ch, exists := ep.endpoints[id]; exists {
-		close(ch)
-		delete(ep.endpoints, id)
-	}
+	delete(ep.endpoints, id)
 }
 
 func (ep *Endpoints) Get(id uint64) (chan Packet, bool) {
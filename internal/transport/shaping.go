@@ -0,0 +1,56 @@
+package transport
+
+import (
+	"time"
+	"crypto/rand"
+	mrand "math/rand/v2"
+)
+
+//
+// Shape of the handshake datagrams on the wire. Each one gets random padding
+// and waits a random delay before going out, within the bounds, so neither
+// their sizes nor their timing are the same from one handshake to the next.
+// A zero value leaves them as they are.
+//
+type Shaping struct {
+	MinPadding 	int
+	MaxPadding 	int
+	MinDelay 	time.Duration
+	MaxDelay 	time.Duration
+}
+
+// Random bytes after the packet, ParsePacket ignores whatever follows the
+// payload
+func (s Shaping) Pad(data []byte) []byte {
+	return pad(data, s.MinPadding, s.MaxPadding)
+}
+
+func (s Shaping) Delay() time.Duration {
+	if s.MaxDelay <= s.MinDelay {
+		return s.MinDelay
+	}
+
+	return s.MinDelay + mrand.N(s.MaxDelay - s.MinDelay + 1)
+}
+
+func (s Shaping) Wait() {
+	if delay := s.Delay(); delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+func pad(data []byte, minSize, maxSize int) []byte {
+	size := minSize
+	if maxSize > minSize {
+		size += mrand.IntN(maxSize - minSize + 1)
+	}
+
+	padding := make([]byte, size)
+	rand.Read(padding)
+
+	padded := make([]byte, 0, len(data) + size)
+	padded = append(padded, data...)
+	padded = append(padded, padding...)
+
+	return padded
+}
@@ -1,54 +1,157 @@
 package transport
 
 import (
+	"io"
 	"time"
 	"net"
 	"sync"
+	"errors"
 	"context"
 	"drill/pkg/netio"
 )
 
+//
+// Forward a TCP connection over an established session until both directions
+// finish, the stream is aborted, it stays idle for too long or the session
+// (the parent context) goes away. The TCP connection is closed on return.
+//
+func RunStream(
+	ctx context.Context,
+	conn net.Conn,
+	sendCh chan<-Packet,
+	recvCh <-chan Packet,
+	cid, localId, remoteId uint64,
+	idleTimeout time.Duration,
+) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer conn.Close()
+
+	idle := NewIdleTimer(idleTimeout)
+	syncCh := make(chan Packet, 65535)
+	watchDone := make(chan struct{})
+
+	go func() {
+		defer close(watchDone)
+
+		select {
+		case <-idle.Watch(ctx):
+			sendCh <- NewRstPacket(cid, 0, localId, remoteId)
+			netio.ResetTCP(conn)
+			cancel()
+			break
+		case <-ctx.Done():
+			break
+		}
+	}()
+
+	sendDone := make(chan struct{})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer close(sendDone)
+
+		SendTask2(
+			ctx, cancel, &wg, idle, conn, sendCh, syncCh, cid, localId, remoteId,
+		)
+	}()
+	go RecvTask(
+		ctx, cancel, &wg, idle, conn, sendCh, recvCh, syncCh, sendDone,
+		cid, localId, remoteId,
+	)
+	wg.Wait()
+
+	// Nothing may be sent to sendCh once returned
+	cancel()
+	<-watchDone
+}
+
 func SendTask2(
+	ctx context.Context,
+	abort context.CancelFunc,
 	wg *sync.WaitGroup, 
+	idle *IdleTimer,
 	conn net.Conn, 
 	sendCh chan<-Packet, 
 	syncCh <-chan Packet,
 	cid, localId, remoteId uint64, 
 ) {
 	connCh := make(chan[]byte, 65535)
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
 	trackCh  := make(chan Packet, 2048)
 	clearCh  := make(chan uint64, 2048)
 	notifyCh := make(chan Packet, 2048)
-	go Alert(trackCh, clearCh, notifyCh)
+	go Alert(ctx, trackCh, clearCh, notifyCh)
 
-	go netio.TCPReadAsChannel(ctx, conn, connCh)	
+	readErrCh := make(chan error, 1)
+	go func(connCh chan<-[]byte) {
+		readErrCh <- netio.TCPReadAsChannel(ctx, conn, connCh)	
+	}(connCh)
 
 	pacer := NewSendPacer(cid, localId, remoteId)
+	eof := false
+
+	// Send whatever the window allows, tell if the stream is fully delivered
+	flush := func() bool {
+		for _, pkt := range pacer.Ready() {
+			sendCh<-pkt
+			trackCh<-pkt
+		}
+
+		return eof && pacer.IsEmpty() && !pacer.IsWait()
+	}
 
 	for {
 		select {
+		case <-ctx.Done():
+			wg.Done()
+			return
 		case data := <-connCh:
 			if len(data) == 0 {
+				// The stream was aborted while reading
+				if ctx.Err() != nil {
+					wg.Done()
+					return
+				}
+
+				// Local connection was reset, abort the remote side as well
+				if err := <-readErrCh; err != nil && !errors.Is(err, io.EOF) {
+					sendCh<-NewRstPacket(cid, pacer.Pvt, localId, remoteId)
+					netio.ResetTCP(conn)
+					abort()
+					wg.Done()
+					return
+				}
+
+				// No more reads, finish once everything buffered is ACKed
+				eof = true
+				connCh = nil
+			} else {
+				idle.Touch()
+				pacer.Push(data)
+			}
+
+			if flush() {
 				sendCh<-pacer.Done()
 				wg.Done()
 				return 
 			}
 
-			pacer.Push(data)
-
-			for _, pkt := range pacer.Ready() {
-				sendCh<-pkt
-				trackCh<-pkt
-			}
-
 			break
 		case pkt := <-syncCh:
 			if pkt.Method == ACK {
 				pacer.Update(pkt.Seq)
 				clearCh <-pkt.Seq
+
+				if flush() {
+					sendCh<-pacer.Done()
+					wg.Done()
+					return 
+				}
+
 				break
 			}
 
@@ -65,85 +168,58 @@ func SendTask2(
 	}
 }
 
-func SendTask(
-	wg *sync.WaitGroup, 
-	conn net.Conn, 
-	sendCh chan<-Packet, 
-	syncCh <-chan Packet,
-	cid, localId, remoteId uint64, 
-) {
-	connCh := make(chan[]byte, 65535)
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	go netio.TCPReadAsChannel(ctx, conn, connCh)	
-
-	pacer := NewSendPacer(cid, localId, remoteId)
-	duration := 300*time.Millisecond
-
-	// 
-	// Stop & Wait for the time being
-	//
-	for {
-		if pacer.IsEmpty() {
-
-			data := <-connCh
-		
-			if len(data) == 0 {
-				sendCh <- pacer.Done()
-				wg.Done()
-				return 
-			}
-
-			pacer.Push(data)
-		} 
-
-		packet, _ := pacer.Pop()
-		sendCh <- packet
-		
-		for isWait := true; isWait; {
-			select {
-			case pkt := <-syncCh:
-				if pkt.Method == ACK {
-					pacer.Update(pkt.Seq)
-					isWait = false
-					break
-				}
-
-				if pkt.Method == RECVFIN {
-					wg.Done()
-					return
-				}
-
-				break
-			case <-time.After(duration):
-				for _, pkt := range pacer.Repeat() {
-					sendCh <- pkt
-				}
-				break
-			}
-		}
-	}
-}
-
 func RecvTask(
+	ctx context.Context,
+	abort context.CancelFunc,
 	wg *sync.WaitGroup, 
+	idle *IdleTimer,
 	conn net.Conn, 
 	sendCh chan<-Packet, 
 	recvCh <-chan Packet, 
 	syncCh chan<-Packet,
+	sendDone <-chan struct{},
 	cid, localId, remoteId uint64, 
 ) {
 	pacer := NewRecvPacer()
 
+	// Set once the remote side finished sending
+	var done <-chan struct{}
+
 	for {
-		packet := <-recvCh 
+		var packet Packet
+
+		select {
+		case <-ctx.Done():
+			wg.Done()
+			return
+		case <-done:
+			wg.Done()
+			return
+		case packet = <-recvCh:
+			idle.Touch()
+			break
+		}
 
 		if packet.Method == ACK || packet.Method == RECVFIN {
 			syncCh <- packet
 			continue
 		}
 
+		// Remote side aborted the stream, reset the local connection
+		if packet.Method == RST {
+			netio.ResetTCP(conn)
+			abort()
+			wg.Done()
+			return
+		}
+
+		// Our direction may still wait for its ACKs, keep handing them over
+		// until it's done
+		if packet.Method == SENDFIN {
+			done = sendDone
+			continue
+		}
+
 		if packet.Method != FWD {
 			wg.Done()
 			return
@@ -158,11 +234,24 @@ func RecvTask(
 			continue
 		}
 
+		// Local application went away, abort both directions
 		if err := netio.WriteTCP(conn, data); err != nil {
-			recvFinPkt := NewRecvFinPacket(cid, 0, localId, remoteId)
-			sendCh <- recvFinPkt
+			rstPkt := NewRstPacket(cid, 0, localId, remoteId)
+			sendCh <- rstPkt
+			netio.ResetTCP(conn)
+			abort()
 			wg.Done()
 			return
 		}
 	}
-}
\ No newline at end of file
+}
+
+// Reply RST to data sent to a stream that no longer exists, so the remote
+// side stops retransmitting and frees the stream
+func rejectStaleStream(sendCh chan<-Packet, pkt Packet) {
+	if pkt.Method != FWD && pkt.Method != SENDFIN {
+		return
+	}
+
+	sendCh <- NewRstPacket(pkt.ConnId, 0, pkt.Dst, pkt.Src)
+}
@@ -0,0 +1,107 @@
+package transport
+
+import (
+	"fmt"
+	"sync/atomic"
+	"drill/internal/obfuscate"
+)
+
+//
+// A user of the server, with its own key and what it's allowed to do
+//
+type User struct {
+	Name 		string
+	Pkey 		[]byte
+
+	// "host:port" globs the user may connect to, anything if empty
+	Allow 		[]string
+
+	// Streams the user may have open at once over all its sessions, no limit
+	// if zero
+	MaxStreams 	int
+
+	streams 	atomic.Int64
+}
+
+func NewUser(
+	name string,
+	pkey []byte,
+	allow []string,
+	maxStreams int,
+) (*User, error) {
+	if len(pkey) != 32 {
+		return nil, fmt.Errorf(
+			"key of user %q needs to be 32 bytes, got %v",
+			name,
+			len(pkey),
+		)
+	}
+
+	for _, pattern := range allow {
+		if err := validDstPattern(pattern); err != nil {
+			return nil, fmt.Errorf("malform allow of user %q. %s", name, err)
+		}
+	}
+
+	return &User {
+		Name: name,
+		Pkey: pkey,
+		Allow: allow,
+		MaxStreams: maxStreams,
+	}, nil
+}
+
+func (u *User) String() string {
+	return u.Name
+}
+
+func (u *User) Allowed(dst string) bool {
+	if len(u.Allow) == 0 {
+		return true
+	}
+
+	for _, pattern := range u.Allow {
+		if matchDst(pattern, dst) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Take a stream slot, false if the user has none left. A taken slot is
+// given back by CloseStream.
+func (u *User) OpenStream() bool {
+	n := u.streams.Add(1)
+
+	if u.MaxStreams > 0 && n > int64(u.MaxStreams) {
+		u.streams.Add(-1)
+		return false
+	}
+
+	return true
+}
+
+func (u *User) CloseStream() {
+	u.streams.Add(-1)
+}
+
+//
+// Find the user whose key decodes the first datagram of an address. Nothing
+// in the datagram tells the user apart, only the key that authenticates it.
+//
+func identifyUser(
+	users []*User,
+	protocol string,
+	data []byte,
+) (*User, []byte, error) {
+	for _, user := range users {
+		obfs := obfuscate.BuildObfuscator(protocol, user.Pkey)
+
+		if decoded, err := obfs.Decode(data); err == nil {
+			return user, decoded, nil
+		}
+	}
+
+	return nil, nil, fmt.Errorf("no user can decode the first datagram")
+}
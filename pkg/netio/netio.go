@@ -71,3 +71,12 @@ func TCPReadAsChannel(
 		}
 	}
 }
+
+// Abort a TCP connection, the peer sees a RST instead of a graceful FIN
+func ResetTCP(conn net.Conn) error {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+
+	return conn.Close()
+}
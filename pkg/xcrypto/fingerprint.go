@@ -0,0 +1,26 @@
+package xcrypto
+
+import (
+	"fmt"
+	"strings"
+	"crypto/sha256"
+)
+
+//
+// Short fingerprint of a key, e.g. "3f2a:91bc:07de:55a0". Two operators compare
+// fingerprints rather than the keys, which never leave the config. A static
+// key pair is fingerprinted by its public key.
+//
+func Fingerprint(key []byte) string {
+	h := sha256.New()
+	h.Write([]byte("drill fingerprint"))
+	h.Write(key)
+	sum := h.Sum(nil)
+
+	groups := make([]string, 0, 4)
+	for i := 0; i < 8; i += 2 {
+		groups = append(groups, fmt.Sprintf("%x", sum[i:i+2]))
+	}
+
+	return strings.Join(groups, ":")
+}
@@ -0,0 +1,66 @@
+package xcrypto
+
+import (
+	"io"
+	"log"
+	"fmt"
+	"crypto/rand"
+	"crypto/sha256"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/curve25519"
+)
+
+// Ephemeral X25519 key pair, the private key is never sent anywhere
+func NewKeyPair() ([]byte, []byte) {
+	priv := make([]byte, curve25519.ScalarSize)
+
+	if _, err := rand.Read(priv); err != nil {
+		log.Panicf("init X25519 private key error, %s\n", err)
+	}
+
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		log.Panicf("can't derive X25519 public key, %s\n", err)
+	}
+
+	return priv, pub
+}
+
+// Public key of a static X25519 private key
+func PublicKey(priv []byte) ([]byte, error) {
+	if len(priv) != curve25519.ScalarSize {
+		return nil, fmt.Errorf(
+			"X25519 private key size needs to be %v bytes, got %v",
+			curve25519.ScalarSize,
+			len(priv),
+		)
+	}
+
+	return curve25519.X25519(priv, curve25519.Basepoint)
+}
+
+// Diffie-Hellman of our private key and the peer's public key. Low order
+// points of a malicious peer are rejected.
+func SharedSecret(priv, peerPub []byte) ([]byte, error) {
+	if len(peerPub) != curve25519.PointSize {
+		return nil, fmt.Errorf(
+			"X25519 public key size needs to be %v bytes, got %v",
+			curve25519.PointSize,
+			len(peerPub),
+		)
+	}
+
+	return curve25519.X25519(priv, peerPub)
+}
+
+// HKDF-SHA256 of a secret into a key of the given size
+func DeriveKey(secret, salt, info []byte, nbytes int) []byte {
+	key := make([]byte, nbytes)
+	kdf := hkdf.New(sha256.New, secret, salt, info)
+
+	if _, err := io.ReadFull(kdf, key); err != nil {
+		log.Panicf("can't derive key, %s\n", err)
+	}
+
+	return key
+}
@@ -0,0 +1,176 @@
+package xcrypto
+
+import (
+	"fmt"
+	"crypto/sha256"
+	"encoding/binary"
+	aead "golang.org/x/crypto/chacha20poly1305"
+)
+
+//
+// Noise_NNpsk0_25519_ChaChaPoly_SHA256, see https://noiseprotocol.org/noise.html
+//
+//   -> psk, e
+//   <- e, ee
+//
+// Both sides are authenticated by the PSK only, the ephemeral keys give the
+// forward secrecy. Payloads are left empty, so both messages have the same
+// size, an ephemeral public key followed by an AEAD tag.
+//
+const NOISE_PROTOCOL string = "Noise_NNpsk0_25519_ChaChaPoly_SHA256"
+const NOISE_MSG_SIZE int = 32 + aead.Overhead
+
+type NoiseState struct {
+	initiator 	bool
+	psk 		[]byte
+
+	// Symmetric state
+	ck 			[]byte
+	h 			[]byte
+	k 			[]byte
+	n 			uint64
+
+	// Our ephemeral key pair and the peer's public one
+	ePriv 		[]byte
+	ePub 		[]byte
+	re 			[]byte
+}
+
+func NewNoiseState(psk []byte, initiator bool) *NoiseState {
+	// The protocol name is longer than the hash, so it's hashed
+	h := sha256.Sum256([]byte(NOISE_PROTOCOL))
+
+	ns := &NoiseState {
+		initiator: initiator,
+		psk: psk,
+		ck: h[:],
+		h: h[:],
+	}
+
+	// Empty prologue
+	ns.mixHash(nil)
+
+	return ns
+}
+
+// The initiator writes the first message, the responder the second one
+func (ns *NoiseState) WriteMessage() ([]byte, error) {
+	if ns.initiator {
+		ns.mixKeyAndHash(ns.psk)
+	}
+
+	ns.ePriv, ns.ePub = NewKeyPair()
+	msg := append([]byte{}, ns.ePub...)
+	ns.mixHash(ns.ePub)
+	ns.mixKey(ns.ePub)
+
+	if !ns.initiator {
+		if err := ns.mixDH(); err != nil {
+			return nil, err
+		}
+	}
+
+	return ns.encryptAndHash(msg, nil)
+}
+
+func (ns *NoiseState) ReadMessage(msg []byte) error {
+	if len(msg) != NOISE_MSG_SIZE {
+		return fmt.Errorf(
+			"unmatched noise message size, want %v, got %v",
+			NOISE_MSG_SIZE,
+			len(msg),
+		)
+	}
+
+	if !ns.initiator {
+		ns.mixKeyAndHash(ns.psk)
+	}
+
+	ns.re = append([]byte{}, msg[:32]...)
+	ns.mixHash(ns.re)
+	ns.mixKey(ns.re)
+
+	if ns.initiator {
+		if err := ns.mixDH(); err != nil {
+			return err
+		}
+	}
+
+	_, err := ns.decryptAndHash(msg[32:])
+
+	return err
+}
+
+// The keys of both directions once the handshake is done, the initiator's
+// sending key comes first
+func (ns *NoiseState) Split() ([]byte, []byte) {
+	out := DeriveKey(nil, ns.ck, nil, 64)
+
+	return out[:32], out[32:]
+}
+
+func (ns *NoiseState) mixHash(data []byte) {
+	sum := sha256.New()
+	sum.Write(ns.h)
+	sum.Write(data)
+	ns.h = sum.Sum(nil)
+}
+
+func (ns *NoiseState) mixKey(ikm []byte) {
+	out := DeriveKey(ikm, ns.ck, nil, 64)
+	ns.ck, ns.k, ns.n = out[:32], out[32:], 0
+}
+
+func (ns *NoiseState) mixKeyAndHash(ikm []byte) {
+	out := DeriveKey(ikm, ns.ck, nil, 96)
+	ns.ck = out[:32]
+	ns.mixHash(out[32:64])
+	ns.k, ns.n = out[64:], 0
+}
+
+func (ns *NoiseState) mixDH() error {
+	shared, err := SharedSecret(ns.ePriv, ns.re)
+	if err != nil {
+		return err
+	}
+
+	ns.mixKey(shared)
+
+	return nil
+}
+
+func (ns *NoiseState) nonce() []byte {
+	nonce := make([]byte, aead.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], ns.n)
+	ns.n += 1
+
+	return nonce
+}
+
+func (ns *NoiseState) encryptAndHash(dst, plntxt []byte) ([]byte, error) {
+	cphr, err := aead.New(ns.k)
+	if err != nil {
+		return nil, err
+	}
+
+	cphrtxt := cphr.Seal(nil, ns.nonce(), plntxt, ns.h)
+	ns.mixHash(cphrtxt)
+
+	return append(dst, cphrtxt...), nil
+}
+
+func (ns *NoiseState) decryptAndHash(cphrtxt []byte) ([]byte, error) {
+	cphr, err := aead.New(ns.k)
+	if err != nil {
+		return nil, err
+	}
+
+	plntxt, err := cphr.Open(nil, ns.nonce(), cphrtxt, ns.h)
+	if err != nil {
+		return nil, fmt.Errorf("can't authenticate noise message, %s", err)
+	}
+
+	ns.mixHash(cphrtxt)
+
+	return plntxt, nil
+}
@@ -0,0 +1,79 @@
+package xcrypto
+
+import (
+	"log"
+	"fmt"
+	"golang.org/x/crypto/scrypt"
+)
+
+//
+// A key sealed with a passphrase, e.g. in a key file of a laptop that may get
+// lost. The passphrase goes through scrypt, its cost is kept along so it can
+// be raised later without breaking the existing files.
+//
+// Sealed: Version(1) + LogN(1) + R(1) + P(1) + Salt(16) + Encrypted key
+//
+const (
+	sealedKeyVersion byte = 1
+	sealedKeyLogN byte = 15
+	sealedKeyR byte = 8
+	sealedKeyP byte = 1
+	sealedKeySalt int = 16
+	sealedKeyHeader int = 4 + sealedKeySalt
+)
+
+func SealKey(key, passphrase []byte) []byte {
+	salt := RandomKey(sealedKeySalt)
+	header := []byte { sealedKeyVersion, sealedKeyLogN, sealedKeyR, sealedKeyP }
+
+	kek, err := passphraseKey(passphrase, salt, header)
+	if err != nil {
+		log.Panicf("can't derive key of passphrase, %s\n", err)
+	}
+
+	cphr := NewXCipher(kek)
+
+	sealed := make([]byte, 0, sealedKeyHeader + len(key) + cphr.Overhead())
+	sealed = append(sealed, header...)
+	sealed = append(sealed, salt...)
+	sealed = append(sealed, cphr.Encrypt(key)...)
+
+	return sealed
+}
+
+func OpenKey(sealed, passphrase []byte) ([]byte, error) {
+	if len(sealed) < sealedKeyHeader {
+		return nil, fmt.Errorf("not enough bytes of sealed key")
+	}
+
+	if sealed[0] != sealedKeyVersion {
+		return nil, fmt.Errorf("unknown sealed key version %v", sealed[0])
+	}
+
+	header, salt := sealed[:4], sealed[4:sealedKeyHeader]
+
+	kek, err := passphraseKey(passphrase, salt, header)
+	if err != nil {
+		return nil, err
+	}
+
+	cphr := NewXCipher(kek)
+
+	key, err := cphr.Decrypt(sealed[sealedKeyHeader:])
+	if err != nil {
+		return nil, fmt.Errorf("wrong passphrase or damaged key")
+	}
+
+	return key, nil
+}
+
+func passphraseKey(passphrase, salt, header []byte) ([]byte, error) {
+	logN, r, p := header[1], header[2], header[3]
+
+	// A forged header can't make us spin or allocate forever
+	if logN < 10 || logN > 22 || r == 0 || p == 0 || int(r) * int(p) > 64 {
+		return nil, fmt.Errorf("unsupported scrypt cost of sealed key")
+	}
+
+	return scrypt.Key(passphrase, salt, 1 << logN, int(r), int(p), 32)
+}
@@ -3,11 +3,58 @@ package xcrypto
 import (
 	"log"
 	"fmt"
+	"crypto/aes"
 	"crypto/rand"
 	"crypto/cipher"
 	aead "golang.org/x/crypto/chacha20poly1305"
 )
 
+//
+// AEAD cipher suites, ChaCha20-Poly1305 is the default one
+//
+const (
+	SuiteChaCha20Poly1305 int = iota
+	SuiteAES128GCM
+	SuiteAES256GCM
+	SuiteXChaCha20Poly1305
+)
+
+var suiteNames = map[string]int {
+	"chacha20-poly1305": SuiteChaCha20Poly1305,
+	"aes-128-gcm": SuiteAES128GCM,
+	"aes-256-gcm": SuiteAES256GCM,
+	"xchacha20-poly1305": SuiteXChaCha20Poly1305,
+}
+
+// Every suite, from the most to the least preferred by default
+var AllSuites = []int {
+	SuiteChaCha20Poly1305,
+	SuiteAES256GCM,
+	SuiteAES128GCM,
+	SuiteXChaCha20Poly1305,
+}
+
+func ParseSuite(name string) (int, error) {
+	suite, ok := suiteNames[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown cipher suite %q", name)
+	}
+
+	return suite, nil
+}
+
+func ValidSuite(suite int) bool {
+	return suite >= SuiteChaCha20Poly1305 && suite <= SuiteXChaCha20Poly1305
+}
+
+func SuiteKeySize(suite int) int {
+	if suite == SuiteAES128GCM {
+		return 16
+	}
+
+	return 32
+}
+
 func RandomKey(nbytes int) []byte {
 	key := make([]byte, nbytes)
 	rand.Read(key)
@@ -19,26 +66,51 @@ type XCipher struct {
 }
 
 func NewXCipher(key []byte) XCipher {
-	if len(key)	!= aead.KeySize {
+	return NewSuiteXCipher(SuiteChaCha20Poly1305, key)
+}
+
+// Keys longer than the suite's key size are cut to it, so a 32 bytes session
+// key fits every suite
+func NewSuiteXCipher(suite int, key []byte) XCipher {
+	size := SuiteKeySize(suite)
+
+	if len(key) < size {
 		log.Panicf(
-			"chacha20poly1305 key size needs to be 32 bytes, got %v\n", 
+			"cipher suite %v key size needs to be %v bytes, got %v\n", 
+			suite,
+			size,
 			len(key),
 		)
 	}
 
-	cphr, err := aead.New(key)
+	var cphr cipher.AEAD
+	var err error
+
+	switch suite {
+	case SuiteAES128GCM, SuiteAES256GCM:
+		var block cipher.Block
+		if block, err = aes.NewCipher(key[:size]); err == nil {
+			cphr, err = cipher.NewGCM(block)
+		}
+	case SuiteXChaCha20Poly1305:
+		cphr, err = aead.NewX(key[:size])
+	default:
+		cphr, err = aead.New(key[:size])
+	}
+
 	if err != nil {
-		log.Panicf("can't create chacha20poly1305 cipher, %s\n", err)
+		log.Panicf("can't create cipher of suite %v, %s\n", suite, err)
 	}
 
 	return XCipher { cphr }
 }
 
 func (cphr *XCipher) Encrypt(plntxt []byte) []byte {
+	nonceSize := cphr.Cipher.NonceSize()
 	nonce := make(
 		[]byte,
-		aead.NonceSize, 
-		aead.NonceSize + len(plntxt) + aead.Overhead,
+		nonceSize, 
+		nonceSize + len(plntxt) + cphr.Cipher.Overhead(),
 	)
 
 	if _, err := rand.Read(nonce); err != nil {
@@ -50,11 +122,13 @@ func (cphr *XCipher) Encrypt(plntxt []byte) []byte {
 }
 
 func (cphr *XCipher) Decrypt(cphrtxt []byte) ([] byte, error) {
-	if len(cphrtxt) < aead.NonceSize {
+	nonceSize := cphr.Cipher.NonceSize()
+
+	if len(cphrtxt) < nonceSize {
 		return nil, fmt.Errorf("can't decrypt ciphertext, unmatched nonce size")
 	}
 
-	nonce, cphrtxt := cphrtxt[:aead.NonceSize], cphrtxt[aead.NonceSize:]
+	nonce, cphrtxt := cphrtxt[:nonceSize], cphrtxt[nonceSize:]
 	plntxt, err := cphr.Cipher.Open(nil, nonce, cphrtxt, nil)
 
 	if err != nil {
@@ -63,3 +137,8 @@ func (cphr *XCipher) Decrypt(cphrtxt []byte) ([] byte, error) {
 
 	return plntxt, nil
 }
+
+// Bytes added to the plaintext by Encrypt
+func (cphr *XCipher) Overhead() int {
+	return cphr.Cipher.NonceSize() + cphr.Cipher.Overhead()
+}
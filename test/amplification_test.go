@@ -0,0 +1,40 @@
+package test
+
+import (
+	"log"
+	"testing"
+	txp "drill/internal/transport"
+)
+
+func TestAmpBudget(t *testing.T) {
+	budget := txp.NewAmpBudget(3, 1200, false)
+
+	if !budget.Spend(3000) {
+		log.Fatalf("bytes within the budget should be sent")
+	}
+
+	if budget.Spend(601) {
+		log.Fatalf("bytes beyond 3 times the received ones should be held")
+	}
+
+	// Hearing from the address again grows the budget
+	budget.OnRecv(100)
+	if !budget.Spend(900) {
+		log.Fatalf("received bytes should grow the budget")
+	}
+
+	budget.Validate()
+	if !budget.Spend(1 << 20) {
+		log.Fatalf("validated address should have no limit")
+	}
+
+	// Addresses validated by a retry token, or paths without a budget
+	if !txp.NewAmpBudget(3, 0, true).Spend(1 << 20) {
+		log.Fatalf("address validated upfront should have no limit")
+	}
+
+	var none *txp.AmpBudget
+	if !none.Spend(1 << 20) {
+		log.Fatalf("nil budget should have no limit")
+	}
+}
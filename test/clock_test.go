@@ -0,0 +1,79 @@
+package test
+
+import (
+	"log"
+	"time"
+	"errors"
+	"testing"
+	txp "drill/internal/transport"
+)
+
+func TestCheckFreshness(t *testing.T) {
+	skew := 30*time.Second
+
+	if err := txp.CheckFreshness(time.Now(), 0, skew); err != nil {
+		log.Fatalf("packet stamped now should be fresh. %s", err)
+	}
+
+	// A client a few seconds off either way still gets through
+	ahead := time.Now().Add(10*time.Second)
+	behind := time.Now().Add(-10*time.Second)
+
+	if err := txp.CheckFreshness(ahead, 0, skew); err != nil {
+		log.Fatalf("clock ahead within the tolerance should pass. %s", err)
+	}
+
+	if err := txp.CheckFreshness(behind, 0, skew); err != nil {
+		log.Fatalf("clock behind within the tolerance should pass. %s", err)
+	}
+
+	far := time.Now().Add(5*time.Minute)
+	if err := txp.CheckFreshness(far, 0, skew); !errors.Is(err, txp.ErrClockSkew) {
+		log.Fatalf("clock far ahead should give ErrClockSkew, got %v", err)
+	}
+
+	old := time.Now().Add(-5*time.Minute)
+	if err := txp.CheckFreshness(old, 0, skew); !errors.Is(err, txp.ErrClockSkew) {
+		log.Fatalf("old stamp should give ErrClockSkew, got %v", err)
+	}
+}
+
+func TestSkewPacket(t *testing.T) {
+	flight := txp.NewInitPacket([]byte("key agreement"))
+	answer := txp.NewSkewPacket(flight.Payload)
+
+	parsed, err := txp.ParsePacket(answer.AsBytes())
+	if err != nil {
+		log.Fatalf("can't parse SKEW packet. %s", err)
+	}
+
+	server, err := txp.ParseSkewPacket(parsed, flight.Payload)
+	if err != nil {
+		log.Fatalf("can't take the time of a SKEW packet. %s", err)
+	}
+
+	if time.Since(server).Abs() > time.Second {
+		log.Fatalf("SKEW packet should carry the server's time")
+	}
+
+	other := txp.NewInitPacket([]byte("key agreement"))
+	if _, err := txp.ParseSkewPacket(parsed, other.Payload); err == nil {
+		log.Fatalf("SKEW packet shouldn't answer another flight")
+	}
+}
+
+func TestClockAdjust(t *testing.T) {
+	clock := &txp.Clock{}
+	server := time.Now().Add(-5*time.Minute)
+
+	clock.Adjust(server, time.Now())
+
+	if offset := time.Since(clock.Now()); (offset - 5*time.Minute).Abs() > time.Second {
+		log.Fatalf("clock should follow the server's, off by %v", offset)
+	}
+
+	// Adjusting again to the same time changes nothing
+	if correction := clock.Adjust(clock.Now(), time.Now()); correction.Abs() > time.Second {
+		log.Fatalf("adjusted clock shouldn't move, moved %v", correction)
+	}
+}
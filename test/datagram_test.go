@@ -0,0 +1,70 @@
+package test
+
+import (
+	"log"
+	"bytes"
+	"context"
+	"testing"
+	txp "drill/internal/transport"
+)
+
+func TestDatagram(t *testing.T) {
+	pkts := []txp.Packet {
+		txp.NewFwdPacket(7, 1, 2, 3, []byte("hello world!")),
+		txp.NewAckPacket(7, 4, 5, 6),
+		txp.NewPingPacket(7, 8),
+	}
+
+	pn, parsed, err := txp.ParseDatagram(txp.EncodeDatagram(42, pkts))
+	if err != nil {
+		log.Fatalf("can't parse datagram. %s", err)
+	}
+
+	if pn != 42 {
+		log.Fatalf("unmatched packet number, want 42, got %v", pn)
+	}
+
+	if len(parsed) != len(pkts) {
+		log.Fatalf("want %v frames, got %v", len(pkts), len(parsed))
+	}
+
+	for i, pkt := range pkts {
+		got := parsed[i]
+
+		if got.ConnId != 7 || got.Method != pkt.Method || got.Seq != pkt.Seq ||
+			got.Src != pkt.Src || got.Dst != pkt.Dst ||
+			!bytes.Equal(got.Payload, pkt.Payload) {
+			log.Fatalf("unmatched frame %v, want %v, got %v", i, pkt, got)
+		}
+	}
+
+	// Truncated frames must be rejected
+	raw := txp.EncodeDatagram(1, pkts)
+	if _, _, err := txp.ParseDatagram(raw[:len(raw)-1]); err == nil {
+		log.Fatalf("parsing truncated datagram should fail")
+	}
+}
+
+func TestFramePacker(t *testing.T) {
+	ch := make(chan txp.Packet, 16)
+	payload := make([]byte, 1000)
+
+	ch <- txp.NewAckPacket(1, 0, 1, 1)
+	ch <- txp.NewAckPacket(1, 1, 1, 1)
+	ch <- txp.NewFwdPacket(1, 0, 1, 1, payload)
+	ch <- txp.NewFwdPacket(1, 1, 1, 1, payload)
+
+	packer := txp.NewFramePacker(ch, 1400)
+	ctx := context.Background()
+
+	// Both ACKs and the first data frame fit, the second one doesn't
+	pkts, _ := packer.Next(ctx)
+	if len(pkts) != 3 {
+		log.Fatalf("want 3 frames in the first datagram, got %v", len(pkts))
+	}
+
+	pkts, _ = packer.Next(ctx)
+	if len(pkts) != 1 || pkts[0].Seq != 1 || pkts[0].Method != txp.FWD {
+		log.Fatalf("want the carried over frame alone, got %v", pkts)
+	}
+}
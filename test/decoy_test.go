@@ -0,0 +1,165 @@
+package test
+
+import (
+	"log"
+	"net"
+	"time"
+	"bytes"
+	"testing"
+	txp "drill/internal/transport"
+)
+
+func listenUDP() *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr { IP: net.IPv4(127, 0, 0, 1) })
+	if err != nil {
+		log.Fatalf("can't listen on UDP. %s", err)
+	}
+
+	return conn
+}
+
+// A decoy service answering every datagram with copies of it, after delay
+func decoyService(copies int, delay time.Duration) *net.UDPConn {
+	service := listenUDP()
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := service.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+
+			data := append([]byte{}, buf[:n]...)
+
+			time.AfterFunc(delay, func() {
+				for range copies {
+					service.WriteToUDP(data, addr)
+				}
+			})
+		}
+	}()
+
+	return service
+}
+
+// Count the datagrams coming to conn until it's quiet
+func countDatagrams(conn *net.UDPConn) int {
+	buf := make([]byte, 65535)
+	count := 0
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(300*time.Millisecond))
+
+		if _, _, err := conn.ReadFromUDP(buf); err != nil {
+			return count
+		}
+
+		count++
+	}
+}
+
+func TestDecoyRelay(t *testing.T) {
+	// A decoy service echoing everything
+	service := decoyService(1, 0)
+	defer service.Close()
+
+	server := listenUDP()
+	defer server.Close()
+	prober := listenUDP()
+	defer prober.Close()
+
+	decoy := txp.NewDecoy(service.LocalAddr().(*net.UDPAddr), 3, 16)
+	probe := []byte("not a drill datagram")
+
+	decoy.Forward(server, prober.LocalAddr().(*net.UDPAddr), probe)
+
+	// The answer comes from the server's address, as if it was the service
+	buf := make([]byte, 65535)
+	prober.SetReadDeadline(time.Now().Add(2*time.Second))
+
+	n, addr, err := prober.ReadFromUDP(buf)
+	if err != nil {
+		log.Fatalf("prober should get the decoy's answer. %s", err)
+	}
+
+	if !bytes.Equal(buf[:n], probe) {
+		log.Fatalf("prober got another answer than the decoy's")
+	}
+
+	if addr.Port != server.LocalAddr().(*net.UDPAddr).Port {
+		log.Fatalf("decoy's answer should come from the server's address")
+	}
+
+	// Without a decoy nothing is sent
+	var none *txp.Decoy
+	none.Forward(server, prober.LocalAddr().(*net.UDPAddr), probe)
+}
+
+func TestDecoyAmplification(t *testing.T) {
+	// A decoy service answering 10 times what it gets
+	service := decoyService(10, 0)
+	defer service.Close()
+
+	server := listenUDP()
+	defer server.Close()
+	victim := listenUDP()
+	defer victim.Close()
+
+	decoy := txp.NewDecoy(service.LocalAddr().(*net.UDPAddr), 3, 16)
+
+	// The source isn't validated, it gets 3 times what it sent at most
+	decoy.Forward(server, victim.LocalAddr().(*net.UDPAddr), []byte("probe"))
+
+	if n := countDatagrams(victim); n != 3 {
+		log.Fatalf("source should get 3 answers within the budget, got %v", n)
+	}
+
+	// Sending more earns more
+	decoy.Forward(server, victim.LocalAddr().(*net.UDPAddr), []byte("probe"))
+
+	if n := countDatagrams(victim); n != 3 {
+		log.Fatalf("source should get 3 more answers, got %v", n)
+	}
+}
+
+func TestDecoyEviction(t *testing.T) {
+	// Answers come late, an evicted relay doesn't deliver its own
+	service := decoyService(1, 200*time.Millisecond)
+	defer service.Close()
+
+	server := listenUDP()
+	defer server.Close()
+
+	decoy := txp.NewDecoy(service.LocalAddr().(*net.UDPAddr), 3, 2)
+
+	probers := []*net.UDPConn{ listenUDP(), listenUDP(), listenUDP() }
+	for _, prober := range probers {
+		defer prober.Close()
+	}
+
+	forward := func(i int) {
+		decoy.Forward(server, probers[i].LocalAddr().(*net.UDPAddr), []byte("probe"))
+		time.Sleep(10*time.Millisecond)
+	}
+
+	// The first source is used again, the second is the least recently used
+	forward(0)
+	forward(1)
+	forward(0)
+
+	// A new source takes the relay of the second, though all are taken
+	forward(2)
+
+	if n := countDatagrams(probers[2]); n != 1 {
+		log.Fatalf("new source should be relayed, got %v answers", n)
+	}
+
+	if n := countDatagrams(probers[0]); n != 2 {
+		log.Fatalf("recently used source should keep its relay, got %v answers", n)
+	}
+
+	if n := countDatagrams(probers[1]); n != 0 {
+		log.Fatalf("least recently used source should be evicted, got %v answers", n)
+	}
+}
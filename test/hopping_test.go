@@ -0,0 +1,31 @@
+package test
+
+import (
+	"log"
+	"net"
+	"testing"
+	txp "drill/internal/transport"
+)
+
+func TestHopping(t *testing.T) {
+	addr := &net.UDPAddr { IP: net.IPv4(127, 0, 0, 1), Port: 9101 }
+	hop := txp.Hopping { MinPort: 9100, MaxPort: 9103 }
+
+	// The given address itself is left out
+	addrs := hop.Addrs(addr)
+	if len(addrs) != 3 {
+		log.Fatalf("want 3 hopping addresses, got %v", addrs)
+	}
+
+	for i := 0; i < 100; i++ {
+		next := hop.Next(addr)
+
+		if !next.IP.Equal(addr.IP) || next.Port < 9100 || next.Port > 9103 {
+			log.Fatalf("hopped out of the range, got %s", next)
+		}
+	}
+
+	if len((txp.Hopping{}).Addrs(addr)) != 0 {
+		log.Fatalf("zero hopping settings shouldn't listen on anything")
+	}
+}
@@ -0,0 +1,145 @@
+package test
+
+import (
+	"log"
+	"bytes"
+	"time"
+	"errors"
+	"testing"
+	"drill/pkg/xcrypto"
+	"drill/internal/obfuscate"
+	txp "drill/internal/transport"
+)
+
+func TestHandshakeStateAccept(t *testing.T) {
+	hs := txp.NewHandshakeState(txp.StepRetry, 0, 0, txp.Shaping{})
+
+	// A step only takes its own message
+	if err := hs.Accept(txp.NewOkPacket(7)); !errors.Is(err, txp.ErrHandshake) {
+		log.Fatalf("OK while waiting for AUTH should fail, got %v", err)
+	}
+
+	// The client learns the connection from the AUTH
+	if err := hs.Accept(txp.NewAuthPacket(7, []byte{ 0 })); err != nil {
+		log.Fatalf("AUTH should be accepted. %s", err)
+	}
+
+	if hs.Cid() != 7 {
+		log.Fatalf("handshake should be of connection 7, got %v", hs.Cid())
+	}
+
+	hs.Move(txp.StepDone)
+
+	if err := hs.Accept(txp.NewAuthPacket(7, []byte{ 0 })); err == nil {
+		log.Fatalf("done handshake shouldn't accept anything")
+	}
+
+	// The server's handshake is bound to its connection
+	server := txp.NewHandshakeState(txp.StepAuth, 3, 0, txp.Shaping{})
+
+	if err := server.Accept(txp.NewConfirmPacket(4, nil)); err == nil {
+		log.Fatalf("OK of another connection should fail")
+	}
+
+	if err := server.Accept(txp.NewConfirmPacket(3, nil)); err != nil {
+		log.Fatalf("OK of the connection should be accepted. %s", err)
+	}
+}
+
+func TestHandshakeStateAwait(t *testing.T) {
+	key := xcrypto.RandomKey(32)
+	obfs := obfuscate.BuildObfuscator("basic", key)
+	recvCh := make(chan txp.Inbound, 4)
+
+	// Junk is dropped, the OK behind it is taken
+	ok := txp.NewConfirmPacket(5, []byte("proof"))
+	recvCh <- txp.Inbound { Data: []byte("junk from anybody") }
+	recvCh <- txp.Inbound { Data: obfs.Encode(ok.AsBytes()) }
+
+	hs := txp.NewHandshakeState(txp.StepAuth, 5, 0, txp.Shaping{})
+
+	pkt, err := hs.Await(recvCh, obfs)
+	if err != nil || pkt.Method != txp.OK {
+		log.Fatalf("OK behind junk should be awaited. %v", err)
+	}
+
+	// A PING or another connection's OK is dropped too
+	ping := txp.NewPingPacket(5, 1)
+	other := txp.NewConfirmPacket(6, []byte("proof"))
+	recvCh <- txp.Inbound { Data: obfs.Encode(ping.AsBytes()) }
+	recvCh <- txp.Inbound { Data: obfs.Encode(other.AsBytes()) }
+	recvCh <- txp.Inbound { Data: obfs.Encode(ok.AsBytes()) }
+
+	hs = txp.NewHandshakeState(txp.StepAuth, 5, 0, txp.Shaping{})
+
+	pkt, err = hs.Await(recvCh, obfs)
+	if err != nil || pkt.ConnId != 5 {
+		log.Fatalf("OK behind a PING and a stray OK should be awaited. %v", err)
+	}
+
+	// Nothing but dropped packets until the deadline
+	recvCh <- txp.Inbound { Data: obfs.Encode(ping.AsBytes()) }
+
+	hs = txp.NewHandshakeState(txp.StepAuth, 5, 100 * time.Millisecond, txp.Shaping{})
+
+	if _, err := hs.Await(recvCh, obfs); !errors.Is(err, txp.ErrHandshake) {
+		log.Fatalf("handshake should time out, got %v", err)
+	}
+}
+
+func TestConfirmProof(t *testing.T) {
+	secret := xcrypto.RandomKey(32)
+	init, auth := []byte("init payload"), []byte("auth payload")
+
+	proof := txp.NewConfirmProof(secret, init, auth)
+
+	if !txp.ValidateConfirmProof(proof, secret, init, auth) {
+		log.Fatalf("can't validate confirmation proof")
+	}
+
+	if txp.ValidateConfirmProof(proof, secret, init, []byte("other auth")) {
+		log.Fatalf("confirmation of another transcript should fail")
+	}
+}
+
+func TestHandshakeRetransmit(t *testing.T) {
+	key := xcrypto.RandomKey(32)
+	obfs := obfuscate.BuildObfuscator("basic", key)
+	sendCh := make(chan txp.Outbound, 16)
+	recvCh := make(chan txp.Inbound, 4)
+
+	// Our flight goes again and again until the handshake times out
+	hs := txp.NewHandshakeState(txp.StepAuth, 5, 1*time.Second, txp.Shaping{})
+	flight := hs.Send(sendCh, txp.NewAuthPacket(5, []byte("auth")), obfs)
+
+	if _, err := hs.Await(recvCh, obfs); !errors.Is(err, txp.ErrHandshake) {
+		log.Fatalf("handshake should time out, got %v", err)
+	}
+
+	// The flight, then the retransmissions after 250ms, 750ms
+	if len(sendCh) != 3 {
+		log.Fatalf("flight should be sent 3 times, sent %v", len(sendCh))
+	}
+
+	for len(sendCh) > 0 {
+		if out := <-sendCh; !bytes.Equal(out.Data, flight) {
+			log.Fatalf("retransmission should be the flight, got %q", out.Data)
+		}
+	}
+
+	// A repeat of the peer's datagram, behind a retry token or not, is
+	// answered with the flight again
+	hs.Answer([]byte("init"))
+
+	if !hs.Repeat([]byte("tokeninit")) || !hs.Repeat([]byte("init")) {
+		log.Fatalf("repeated datagram should be answered")
+	}
+
+	if hs.Repeat([]byte("other")) {
+		log.Fatalf("another datagram shouldn't be answered")
+	}
+
+	if len(sendCh) != 2 {
+		log.Fatalf("flight should be sent 2 times, sent %v", len(sendCh))
+	}
+}
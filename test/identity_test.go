@@ -0,0 +1,65 @@
+package test
+
+import (
+	"log"
+	"bytes"
+	"errors"
+	"testing"
+	txp "drill/internal/transport"
+	"drill/pkg/xcrypto"
+)
+
+func TestServerIdentity(t *testing.T) {
+	priv, pub := xcrypto.NewKeyPair()
+
+	identity, err := txp.NewIdentity(priv)
+	if err != nil {
+		log.Fatalf("can't load server identity. %s", err)
+	}
+
+	if !bytes.Equal(identity.Pub, pub) {
+		log.Fatalf("identity gives another public key")
+	}
+
+	if _, err := txp.NewIdentity(priv[:16]); err == nil {
+		log.Fatalf("short private key should be rejected")
+	}
+}
+
+func TestServerIdentityPinning(t *testing.T) {
+	psk := xcrypto.RandomKey(32)
+	identity := txp.RandomIdentity()
+	impostor := txp.RandomIdentity()
+
+	handshake := func(pinned []byte, server txp.Identity) error {
+		kex := txp.NewClientKex(txp.HandshakeBasic, psk, pinned)
+
+		init, err := kex.Init()
+		if err != nil {
+			return err
+		}
+
+		reply, _, err := txp.ServerKex(txp.HandshakeBasic, server, psk, init)
+		if err != nil {
+			return err
+		}
+
+		_, err = kex.Finish(reply)
+
+		return err
+	}
+
+	if err := handshake(identity.Pub, identity); err != nil {
+		log.Fatalf("pinned server should be accepted. %s", err)
+	}
+
+	// Knowing the PSK isn't enough to pass as the server
+	if err := handshake(identity.Pub, impostor); !errors.Is(err, txp.ErrIdentity) {
+		log.Fatalf("impostor should give ErrIdentity, got %v", err)
+	}
+
+	// Without a pinned key any PSK holder is trusted
+	if err := handshake(nil, impostor); err != nil {
+		log.Fatalf("unpinned client should accept any server. %s", err)
+	}
+}
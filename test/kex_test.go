@@ -0,0 +1,49 @@
+package test
+
+import (
+	"log"
+	"bytes"
+	"testing"
+	txp "drill/internal/transport"
+	"drill/pkg/xcrypto"
+)
+
+func TestSessionKeyAgreement(t *testing.T) {
+	psk := xcrypto.RandomKey(32)
+	clientPriv, clientPub := xcrypto.NewKeyPair()
+	serverPriv, serverPub := xcrypto.NewKeyPair()
+
+	clientShared, err := xcrypto.SharedSecret(clientPriv, serverPub)
+	if err != nil {
+		log.Fatalf("client can't agree on a secret. %s", err)
+	}
+
+	serverShared, err := xcrypto.SharedSecret(serverPriv, clientPub)
+	if err != nil {
+		log.Fatalf("server can't agree on a secret. %s", err)
+	}
+
+	clientKey := txp.DeriveSessionKey(clientShared, psk, clientPub, serverPub)
+	serverKey := txp.DeriveSessionKey(serverShared, psk, clientPub, serverPub)
+
+	if !bytes.Equal(clientKey, serverKey) {
+		log.Fatalf("both sides should derive the same session key")
+	}
+
+	// Another PSK gives another key
+	otherKey := txp.DeriveSessionKey(
+		clientShared, 
+		xcrypto.RandomKey(32), 
+		clientPub, 
+		serverPub,
+	)
+
+	if bytes.Equal(clientKey, otherKey) {
+		log.Fatalf("session key should depend on the PSK")
+	}
+
+	// A low order point must not produce a secret
+	if _, err := xcrypto.SharedSecret(clientPriv, make([]byte, 32)); err == nil {
+		log.Fatalf("low order public key should be rejected")
+	}
+}
@@ -0,0 +1,92 @@
+package test
+
+import (
+	"os"
+	"log"
+	"bytes"
+	"testing"
+	"path/filepath"
+	"drill/pkg/xcrypto"
+	"drill/internal/config"
+)
+
+func TestFingerprint(t *testing.T) {
+	key := xcrypto.RandomKey(32)
+
+	if xcrypto.Fingerprint(key) != xcrypto.Fingerprint(key) {
+		log.Fatalf("fingerprint of a key should stay the same")
+	}
+
+	if xcrypto.Fingerprint(key) == xcrypto.Fingerprint(xcrypto.RandomKey(32)) {
+		log.Fatalf("fingerprints of two keys should differ")
+	}
+
+	if len(xcrypto.Fingerprint(key)) != len("3f2a:91bc:07de:55a0") {
+		log.Fatalf("fingerprint should be short, got %s", xcrypto.Fingerprint(key))
+	}
+}
+
+func TestKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "psk.key")
+	key := xcrypto.RandomKey(32)
+
+	if err := config.WriteKeyFile(path, key, nil); err != nil {
+		log.Fatalf("can't write key file. %s", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0o600 {
+		log.Fatalf("key file should be readable by its owner only")
+	}
+
+	read, err := config.ReadKeyFile(path)
+	if err != nil || !bytes.Equal(read, key) {
+		log.Fatalf("can't read back the key file. %v", err)
+	}
+
+	if err := config.WriteKeyFile(path, key, nil); err == nil {
+		log.Fatalf("existing key file shouldn't be overwritten")
+	}
+
+	os.Chmod(path, 0o644)
+
+	if _, err := config.ReadKeyFile(path); err == nil {
+		log.Fatalf("world-readable key file should be refused")
+	}
+}
+
+func TestSealedKey(t *testing.T) {
+	key := xcrypto.RandomKey(32)
+	sealed := xcrypto.SealKey(key, []byte("hunter2"))
+
+	opened, err := xcrypto.OpenKey(sealed, []byte("hunter2"))
+	if err != nil || !bytes.Equal(opened, key) {
+		log.Fatalf("can't open sealed key. %v", err)
+	}
+
+	if _, err := xcrypto.OpenKey(sealed, []byte("hunter3")); err == nil {
+		log.Fatalf("sealed key shouldn't open with a wrong passphrase")
+	}
+}
+
+func TestEncryptedKeyFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "psk.key")
+	key := xcrypto.RandomKey(32)
+
+	if err := config.WriteKeyFile(path, key, []byte("hunter2")); err != nil {
+		log.Fatalf("can't write encrypted key file. %s", err)
+	}
+
+	t.Setenv(config.PassphraseEnv, "hunter2")
+
+	read, err := config.ReadKeyFile(path)
+	if err != nil || !bytes.Equal(read, key) {
+		log.Fatalf("can't read back the encrypted key file. %v", err)
+	}
+
+	t.Setenv(config.PassphraseEnv, "hunter3")
+
+	if _, err := config.ReadKeyFile(path); err == nil {
+		log.Fatalf("encrypted key file shouldn't open with a wrong passphrase")
+	}
+}
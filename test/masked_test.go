@@ -0,0 +1,63 @@
+package test
+
+import (
+	"log"
+	"bytes"
+	"testing"
+	"encoding/binary"
+	"drill/pkg/xcrypto"
+	"drill/internal/obfuscate"
+)
+
+func TestMaskedObfuscator(t *testing.T) {
+	for _, suite := range xcrypto.AllSuites {
+		key := xcrypto.RandomKey(xcrypto.SuiteKeySize(suite))
+		obfs := obfuscate.BuildSuiteObfuscator("masked", suite, key)
+		data := []byte("some datagram of a session")
+
+		encoded := obfs.Encode(data)
+
+		if len(encoded) != len(data) + obfs.Overhead() {
+			log.Fatalf("masked datagram of suite %v has the wrong size", suite)
+		}
+
+		decoded, err := obfs.Decode(encoded)
+		if err != nil || !bytes.Equal(decoded, data) {
+			log.Fatalf("can't decode masked datagram of suite %v. %v", suite, err)
+		}
+
+		tampered := append([]byte{}, encoded...)
+		tampered[0] ^= 1
+
+		if _, err := obfs.Decode(tampered); err == nil {
+			log.Fatalf("masked datagram with a tampered size should fail")
+		}
+
+		other := obfuscate.BuildSuiteObfuscator("masked", suite, xcrypto.RandomKey(len(key)))
+		if _, err := other.Decode(encoded); err == nil {
+			log.Fatalf("masked datagram shouldn't decode with another key")
+		}
+	}
+}
+
+func TestMaskedSizeHidden(t *testing.T) {
+	obfs := obfuscate.BuildObfuscator("masked", xcrypto.RandomKey(32))
+	data := make([]byte, 100)
+
+	// The same size is masked differently on every datagram
+	seen := make(map[uint32]bool)
+
+	for i := 0; i < 16; i++ {
+		prefix := binary.BigEndian.Uint32(obfs.Encode(data)[0:4])
+
+		if prefix == uint32(len(data)) {
+			log.Fatalf("size of masked datagram shows in the clear")
+		}
+
+		seen[prefix] = true
+	}
+
+	if len(seen) < 16 {
+		log.Fatalf("masked size prefixes shouldn't repeat")
+	}
+}
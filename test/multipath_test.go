@@ -0,0 +1,206 @@
+package test
+
+import (
+	"log"
+	"net"
+	"time"
+	"errors"
+	"testing"
+	"drill/pkg/xcrypto"
+	txp "drill/internal/transport"
+)
+
+// A validated path from conn to a new socket, with its RTT seeded
+func testPath(conn *net.UDPConn, rtt time.Duration) (*txp.Path, *net.UDPConn) {
+	remote := listenUDP()
+
+	path := txp.NewPath(conn, remote.LocalAddr().(*net.UDPAddr))
+	path.Seed(rtt)
+	path.Validate()
+
+	return path, remote
+}
+
+func readDatagram(conn *net.UDPConn) []byte {
+	buf := make([]byte, 65535)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		log.Fatalf("no datagram on %s. %s", conn.LocalAddr(), err)
+	}
+
+	return buf[:n]
+}
+
+func TestParsePathMode(t *testing.T) {
+	cases := map[string]int {
+		"": txp.PathMinRtt,
+		"minrtt": txp.PathMinRtt,
+		"redundant": txp.PathRedundant,
+	}
+
+	for name, want := range cases {
+		got, err := txp.ParsePathMode(name)
+		if err != nil || got != want {
+			log.Fatalf("mode %q, want %v, got %v (%v)", name, want, got, err)
+		}
+	}
+
+	if _, err := txp.ParsePathMode("fastest"); err == nil {
+		log.Fatalf("unknown mode should be rejected")
+	}
+}
+
+func TestPathSetPick(t *testing.T) {
+	conn := listenUDP()
+	defer conn.Close()
+
+	paths := txp.NewPathSet(txp.PathMinRtt, 0)
+
+	slow, slowRemote := testPath(conn, 50*time.Millisecond)
+	fast, fastRemote := testPath(conn, 10*time.Millisecond)
+	defer slowRemote.Close()
+	defer fastRemote.Close()
+
+	// Faster still, but not validated
+	pendingRemote := listenUDP()
+	pending := txp.NewPath(conn, pendingRemote.LocalAddr().(*net.UDPAddr))
+	pending.Seed(time.Millisecond)
+	defer pendingRemote.Close()
+
+	paths.Add(slow)
+	paths.Add(fast)
+	paths.Add(pending)
+
+	// Urgent or not, a single copy goes on the fastest validated path
+	paths.Write(txp.Outbound { Data: []byte("datagram 1") })
+	paths.Write(txp.Outbound { Data: []byte("datagram 2"), Urgent: true })
+
+	counts := []int{
+		countDatagrams(slowRemote),
+		countDatagrams(fastRemote),
+		countDatagrams(pendingRemote),
+	}
+
+	if counts[0] != 0 || counts[1] != 2 || counts[2] != 0 {
+		log.Fatalf("want both datagrams on the fast path, got %v", counts)
+	}
+
+	// A datagram for a given path goes there whatever its RTT
+	paths.Write(txp.Outbound { Data: []byte("probe"), Path: slow })
+
+	if count := countDatagrams(slowRemote); count != 1 {
+		log.Fatalf("want the datagram on its own path, got %v", count)
+	}
+}
+
+func TestPathSetRedundant(t *testing.T) {
+	conn := listenUDP()
+	defer conn.Close()
+
+	paths := txp.NewPathSet(txp.PathRedundant, 0)
+
+	slow, slowRemote := testPath(conn, 50*time.Millisecond)
+	fast, fastRemote := testPath(conn, 10*time.Millisecond)
+	defer slowRemote.Close()
+	defer fastRemote.Close()
+
+	paths.Add(slow)
+	paths.Add(fast)
+
+	// Urgent datagrams go on every path, the others on the fastest one
+	paths.Write(txp.Outbound { Data: []byte("urgent"), Urgent: true })
+	paths.Write(txp.Outbound { Data: []byte("bulk") })
+
+	slowCount, fastCount := countDatagrams(slowRemote), countDatagrams(fastRemote)
+
+	if slowCount != 1 || fastCount != 2 {
+		log.Fatalf(
+			"want 1 datagram on the slow path and 2 on the fast one, got %v and %v",
+			slowCount,
+			fastCount,
+		)
+	}
+}
+
+func TestPathSetDuplicates(t *testing.T) {
+	conn := listenUDP()
+	defer conn.Close()
+
+	paths := txp.NewPathSet(txp.PathRedundant, 0)
+
+	first, firstRemote := testPath(conn, 10*time.Millisecond)
+	second, secondRemote := testPath(conn, 20*time.Millisecond)
+	defer firstRemote.Close()
+	defer secondRemote.Close()
+
+	paths.Add(first)
+	paths.Add(second)
+
+	key := xcrypto.RandomKey(32)
+	suite := xcrypto.SuiteChaCha20Poly1305
+	sender := txp.NewDatagramCodec("basic", suite, key, txp.Rekey{}, true)
+	receiver := txp.NewDatagramCodec("basic", suite, key, txp.Rekey{}, false)
+
+	sealed := sender.Seal([]txp.Packet{ txp.NewPingPacket(1, 1) })
+	paths.Write(txp.Outbound { Data: sealed, Urgent: true })
+
+	// The first copy to arrive is taken, the one from the other path dropped
+	if _, err := receiver.Open(readDatagram(firstRemote)); err != nil {
+		log.Fatalf("first copy of a datagram should open. %s", err)
+	}
+
+	_, err := receiver.Open(readDatagram(secondRemote))
+	if !errors.Is(err, txp.ErrReplay) {
+		log.Fatalf("second copy of a datagram should give ErrReplay, got %v", err)
+	}
+
+	// Another datagram still gets through
+	paths.Write(txp.Outbound { Data: sender.Seal([]txp.Packet{ txp.NewPingPacket(1, 2) }) })
+
+	if _, err := receiver.Open(readDatagram(firstRemote)); err != nil {
+		log.Fatalf("another datagram should open. %s", err)
+	}
+}
+
+func TestPathSetLossyPath(t *testing.T) {
+	conn := listenUDP()
+	defer conn.Close()
+
+	paths := txp.NewPathSet(txp.PathMinRtt, 0)
+
+	lossy, lossyRemote := testPath(conn, 10*time.Millisecond)
+	steady, steadyRemote := testPath(conn, 20*time.Millisecond)
+	defer lossyRemote.Close()
+	defer steadyRemote.Close()
+
+	paths.Add(lossy)
+	paths.Add(steady)
+
+	paths.Write(txp.Outbound { Data: []byte("datagram 1") })
+
+	if count := countDatagrams(lossyRemote); count != 1 {
+		log.Fatalf("faster path should be picked while it doesn't lose, got %v", count)
+	}
+
+	// Probes of the fast path go unanswered
+	for seq := range uint64(10) {
+		lossy.Probe(seq)
+	}
+
+	time.Sleep(2*time.Second + 100*time.Millisecond)
+	lossy.ExpireProbes()
+
+	paths.Write(txp.Outbound { Data: []byte("datagram 2") })
+
+	lossyCount, steadyCount := countDatagrams(lossyRemote), countDatagrams(steadyRemote)
+
+	if lossyCount != 0 || steadyCount != 1 {
+		log.Fatalf(
+			"lossy path should be demoted, got %v on it and %v on the other one",
+			lossyCount,
+			steadyCount,
+		)
+	}
+}
@@ -0,0 +1,77 @@
+package test
+
+import (
+	"log"
+	"bytes"
+	"testing"
+	txp "drill/internal/transport"
+	"drill/pkg/xcrypto"
+)
+
+func TestNoiseHandshake(t *testing.T) {
+	psk := xcrypto.RandomKey(32)
+
+	initiator := xcrypto.NewNoiseState(psk, true)
+	responder := xcrypto.NewNoiseState(psk, false)
+
+	msg1, err := initiator.WriteMessage()
+	if err != nil || len(msg1) != xcrypto.NOISE_MSG_SIZE {
+		log.Fatalf("can't write first noise message. %v", err)
+	}
+
+	if err := responder.ReadMessage(msg1); err != nil {
+		log.Fatalf("can't read first noise message. %s", err)
+	}
+
+	msg2, err := responder.WriteMessage()
+	if err != nil {
+		log.Fatalf("can't write second noise message. %s", err)
+	}
+
+	if err := initiator.ReadMessage(msg2); err != nil {
+		log.Fatalf("can't read second noise message. %s", err)
+	}
+
+	i1, i2 := initiator.Split()
+	r1, r2 := responder.Split()
+
+	if !bytes.Equal(i1, r1) || !bytes.Equal(i2, r2) || bytes.Equal(i1, i2) {
+		log.Fatalf("both sides should split into the same pair of keys")
+	}
+
+	// A responder with another PSK can't read the first message
+	stranger := xcrypto.NewNoiseState(xcrypto.RandomKey(32), false)
+	if err := stranger.ReadMessage(msg1); err == nil {
+		log.Fatalf("noise message under another PSK should be rejected")
+	}
+}
+
+func TestHandshakeKex(t *testing.T) {
+	psk := xcrypto.RandomKey(32)
+	identity := txp.RandomIdentity()
+
+	for _, handshake := range []int{ txp.HandshakeBasic, txp.HandshakeNoise } {
+		kex := txp.NewClientKex(handshake, psk, identity.Pub)
+
+		// The INIT payload is padded, the key agreement must ignore it
+		init, err := kex.Init()
+		if err != nil {
+			log.Fatalf("handshake %v can't init. %s", handshake, err)
+		}
+		init = append(init, xcrypto.RandomKey(64)...)
+
+		reply, serverKey, err := txp.ServerKex(handshake, identity, psk, init)
+		if err != nil {
+			log.Fatalf("handshake %v can't respond. %s", handshake, err)
+		}
+
+		clientKey, err := kex.Finish(reply)
+		if err != nil {
+			log.Fatalf("handshake %v can't finish. %s", handshake, err)
+		}
+
+		if !bytes.Equal(clientKey, serverKey) {
+			log.Fatalf("handshake %v gives different session keys", handshake)
+		}
+	}
+}
@@ -78,14 +78,14 @@ func verifyPacket(
 }
 
 func TestNewPacket(t *testing.T) {
-	pkt := txp.NewPacket(123, txp.TUN, 456, 789, 101112, []byte("hello world!"))
+	pkt := txp.NewPacket(123, txp.FWD, 456, 789, 101112, []byte("hello world!"))
 
 	created := pkt.Created
 
 	err := verifyPacket(
 		pkt,
 		123,
-		txp.TUN,
+		txp.FWD,
 		created,
 		456,
 		789,
@@ -110,7 +110,7 @@ func TestNewPacket(t *testing.T) {
 	err = verifyPacket(
 		parsedPacket,
 		123,
-		txp.TUN,
+		txp.FWD,
 		created,
 		456,
 		789,
@@ -123,71 +123,18 @@ func TestNewPacket(t *testing.T) {
 	}
 }
 
-func TestNewTunPacket(t *testing.T) {
-	tunPkt := txp.NewTunPacket()
-	wantPayload := tunPkt.Payload
-	wantCreated := tunPkt.Created
+func TestNewInitPacket(t *testing.T) {
+	initPkt := txp.NewInitPacket([]byte("key agreement"))
+	wantPayload := initPkt.Payload
+	wantCreated := initPkt.Created
 
-	if err := verifyPacket(
-		tunPkt,
-		0,
-		txp.TUN,
-		wantCreated,
-		0,
-		0,
-		0,
-		wantPayload,
-	); err != nil {
-		log.Fatalf("%s\n", err)
-	}
-
-	// Test the parsing of the Packet
-	raw := tunPkt.AsBytes()
-
-	parsedPacket, err := txp.ParsePacket(raw)
-
-	if err != nil {
-		log.Fatalf("%s\n", err)
-	}
-
-	if err := verifyPacket(
-		parsedPacket,
-		0,
-		txp.TUN,
-		wantCreated,
-		0,
-		0,
-		0,
-		wantPayload,
-	); err != nil {
-		log.Fatalf("%s\n", err)
-	}
-}
-
-func TestNewRetryPacket(t *testing.T) {
-	// Generate random token
-	retryToken := make([]byte, 1024)
-	rand.Read(retryToken)
-
-	retryPkt := txp.NewRetryPacket(retryToken)
-	wantPayload := retryPkt.Payload
-	wantCreated := retryPkt.Created
-
-	if err := verifyPacket(
-		retryPkt,
-		0,
-		txp.TUN,
-		wantCreated,
-		0,
-		0,
-		0,
-		wantPayload,
-	); err != nil {
-		log.Fatalf("%s\n", err)
+	// Padded to the size of a first flight
+	if len(wantPayload) != 1200 {
+		log.Fatalf("INIT payload should be 1200 bytes, got %v", len(wantPayload))
 	}
 
 	// Test the parsing of the Packet
-	raw := retryPkt.AsBytes()
+	raw := initPkt.AsBytes()
 
 	parsedPacket, err := txp.ParsePacket(raw)
 
@@ -198,7 +145,7 @@ func TestNewRetryPacket(t *testing.T) {
 	if err := verifyPacket(
 		parsedPacket,
 		0,
-		txp.TUN,
+		txp.INIT,
 		wantCreated,
 		0,
 		0,
@@ -221,12 +168,12 @@ func TestNewAuthPacket(t *testing.T) {
 	if err := verifyPacket(
 		authPkt,
 		123,
-		txp.TUNAUTH,
+		txp.AUTH,
 		wantCreated,
-		1,
 		0,
 		0,
-		wantPayload,
+		0,
+		authToken,
 	); err != nil {
 		log.Fatalf("%s\n", err)
 	}
@@ -243,9 +190,9 @@ func TestNewAuthPacket(t *testing.T) {
 	if err := verifyPacket(
 		parsedPacket,
 		123,
-		txp.TUNAUTH,
+		txp.AUTH,
 		wantCreated,
-		1,
+		0,
 		0,
 		0,
 		wantPayload,
@@ -253,8 +200,3 @@ func TestNewAuthPacket(t *testing.T) {
 		log.Fatalf("%s\n", err)
 	}
 }
-
-
-
-
-
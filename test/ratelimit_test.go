@@ -0,0 +1,100 @@
+package test
+
+import (
+	"log"
+	"net"
+	"testing"
+	txp "drill/internal/transport"
+)
+
+func TestInitLimiterPerIp(t *testing.T) {
+	limiter := txp.NewInitLimiter(txp.InitLimits { RatePerIp: 5 })
+	ip := net.ParseIP("192.0.2.1")
+
+	// A second of burst, then nothing until the bucket fills up again
+	for i := 0; i < 5; i++ {
+		if !limiter.Allow(ip) {
+			log.Fatalf("first datagram %v of the burst should be allowed", i)
+		}
+	}
+
+	if limiter.Allow(ip) {
+		log.Fatalf("datagram beyond the burst should be dropped")
+	}
+
+	if !limiter.Allow(net.ParseIP("192.0.2.2")) {
+		log.Fatalf("another IP has its own bucket")
+	}
+}
+
+func TestInitLimiterSpoofedFlood(t *testing.T) {
+	limiter := txp.NewInitLimiter(txp.InitLimits { RatePerIp: 10 })
+
+	// A datagram from each of many spoofed addresses, spread over the buckets
+	for i := 0; i < 1 << 17; i++ {
+		limiter.Allow(net.IPv4(10, byte(i >> 16), byte(i >> 8), byte(i)))
+	}
+
+	if !limiter.Allow(net.ParseIP("192.0.2.1")) {
+		log.Fatalf("spoofed flood shouldn't lock out another IP")
+	}
+}
+
+func TestInitLimiterGlobal(t *testing.T) {
+	limiter := txp.NewInitLimiter(txp.InitLimits { Rate: 2 })
+
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if limiter.Allow(net.IPv4(192, 0, 2, byte(i))) {
+			allowed += 1
+		}
+	}
+
+	if allowed != 2 {
+		log.Fatalf("global rate should allow 2 datagrams, got %v", allowed)
+	}
+}
+
+func TestRetryMode(t *testing.T) {
+	always, err := txp.ParseRetryMode("")
+	if err != nil || always != txp.RetryAlways {
+		log.Fatalf("retry should default to always")
+	}
+
+	if !txp.NewInitLimiter(txp.InitLimits { Retry: always }).NeedRetry() {
+		log.Fatalf("retry always should always need a retry")
+	}
+
+	load, err := txp.ParseRetryMode("load")
+	if err != nil || load != txp.RetryLoad {
+		log.Fatalf("can't parse retry mode load")
+	}
+
+	limiter := txp.NewInitLimiter(txp.InitLimits { Retry: load })
+	if limiter.NeedRetry() {
+		log.Fatalf("retry on load shouldn't need a retry without load")
+	}
+
+	// Pile up pending handshakes
+	dones := []func(){}
+	for i := 0; i < 100; i++ {
+		dones = append(dones, limiter.Begin())
+	}
+
+	if !limiter.NeedRetry() {
+		log.Fatalf("retry on load should need a retry under load")
+	}
+
+	for _, done := range dones {
+		done()
+		done()
+	}
+
+	if limiter.NeedRetry() {
+		log.Fatalf("finished handshakes shouldn't count as load")
+	}
+
+	if _, err := txp.ParseRetryMode("never"); err == nil {
+		log.Fatalf("unknown retry mode should be rejected")
+	}
+}
@@ -0,0 +1,194 @@
+package test
+
+import (
+	"fmt"
+	"log"
+	"time"
+	"errors"
+	"testing"
+	txp "drill/internal/transport"
+	"drill/pkg/xcrypto"
+)
+
+func TestReplayWindow(t *testing.T) {
+	var window txp.ReplayWindow
+
+	if window.Check(0) {
+		log.Fatalf("packet number 0 should be rejected")
+	}
+
+	for _, pn := range []uint64{ 1, 3, 2, 100 } {
+		if !window.Check(pn) {
+			log.Fatalf("fresh packet number %v should be accepted", pn)
+		}
+	}
+
+	if window.Check(3) || window.Check(100) {
+		log.Fatalf("replayed packet numbers should be rejected")
+	}
+
+	// Reordered but still within the window
+	if !window.Check(50) {
+		log.Fatalf("reordered packet number should be accepted")
+	}
+
+	// Slide far ahead, the old ones fall out of the window
+	if !window.Check(10000) || window.Check(100) || window.Check(4000) {
+		log.Fatalf("packet numbers behind the window should be rejected")
+	}
+
+	if !window.Check(9999) {
+		log.Fatalf("packet number just behind the top should be accepted")
+	}
+}
+
+func TestReplayCache(t *testing.T) {
+	cache := txp.NewReplayCache()
+	fresh := time.Now().Add(time.Minute)
+
+	if cache.Contains([]byte("init 1")) {
+		log.Fatalf("unknown INIT shouldn't be contained")
+	}
+
+	if cache.Seen([]byte("init 1"), fresh) {
+		log.Fatalf("first INIT shouldn't be seen")
+	}
+
+	if !cache.Seen([]byte("init 1"), fresh) {
+		log.Fatalf("replayed INIT should be seen")
+	}
+
+	if cache.Seen([]byte("init 2"), fresh) {
+		log.Fatalf("another INIT shouldn't be seen")
+	}
+
+	if !cache.Contains([]byte("init 2")) {
+		log.Fatalf("seen INIT should be contained")
+	}
+
+	// A flood of first flights closer to going stale doesn't push a fresh
+	// one out, and doesn't grow the cache without bound either
+	soon := time.Now().Add(30*time.Second)
+	flood := 100000
+
+	for i := range flood {
+		cache.Seen([]byte(fmt.Sprintf("flood %v", i)), soon)
+	}
+
+	if !cache.Seen([]byte("init 1"), fresh) {
+		log.Fatalf("fresh INIT should still be seen after a flood")
+	}
+
+	remembered := 0
+	for i := range flood {
+		if cache.Contains([]byte(fmt.Sprintf("flood %v", i))) {
+			remembered++
+		}
+	}
+
+	if remembered == flood {
+		log.Fatalf("flood should be bounded, all %v INITs are remembered", flood)
+	}
+
+	// Forgotten once it couldn't pass the freshness check anyway
+	cache.Seen([]byte("init 3"), time.Now().Add(-time.Millisecond))
+	cache.Seen([]byte("init 4"), fresh)
+
+	if cache.Contains([]byte("init 3")) {
+		log.Fatalf("expired INIT should be forgotten")
+	}
+}
+
+func TestDatagramCodecReplay(t *testing.T) {
+	key := xcrypto.RandomKey(32)
+	suite := xcrypto.SuiteChaCha20Poly1305
+	sender := txp.NewDatagramCodec("basic", suite, key, txp.Rekey{}, true)
+	receiver := txp.NewDatagramCodec("basic", suite, key, txp.Rekey{}, false)
+
+	sealed := sender.Seal([]txp.Packet{ txp.NewPingPacket(1, 1) })
+
+	if _, err := receiver.Open(sealed); err != nil {
+		log.Fatalf("can't open datagram. %s", err)
+	}
+
+	if _, err := receiver.Open(sealed); !errors.Is(err, txp.ErrReplay) {
+		log.Fatalf("replayed datagram should give ErrReplay, got %v", err)
+	}
+}
+
+func TestDatagramCodecRekey(t *testing.T) {
+	key := xcrypto.RandomKey(32)
+	suite := xcrypto.SuiteChaCha20Poly1305
+	rekey := txp.Rekey { Packets: 2 }
+	client := txp.NewDatagramCodec("basic", suite, key, rekey, true)
+	server := txp.NewDatagramCodec("basic", suite, key, rekey, false)
+
+	ping := []txp.Packet{ txp.NewPingPacket(1, 1) }
+
+	// Sealed in phase 0, delivered late
+	late := client.Seal(ping)
+	client.Seal(ping)
+
+	// Over the limit, the client moves to phase 1
+	sealed := client.Seal(ping)
+	if client.Phase() != 1 {
+		log.Fatalf("client should be in phase 1, got %v", client.Phase())
+	}
+
+	// The server follows once it opens a datagram of the next phase
+	if _, err := server.Open(sealed); err != nil || server.Phase() != 1 {
+		log.Fatalf("server should follow to phase 1. %v", err)
+	}
+
+	// Datagrams in flight from the previous phase still open
+	if _, err := server.Open(late); err != nil {
+		log.Fatalf("previous phase datagram should still open. %s", err)
+	}
+
+	// The phase a datagram carries picks the one key it's opened with
+	for _, flip := range []byte{ 0x01, 0x02, 0x80 } {
+		tampered := client.Seal(ping)
+		tampered[0] ^= flip
+
+		if _, err := server.Open(tampered); err == nil || server.Phase() != 1 {
+			log.Fatalf("datagram claiming another phase shouldn't open")
+		}
+	}
+
+	// And the server's answers open on the client
+	if _, err := client.Open(server.Seal(ping)); err != nil {
+		log.Fatalf("client can't open the server's answer. %s", err)
+	}
+
+	if client.Phase() != 1 || server.Phase() != 1 {
+		log.Fatalf("both sides should stay in phase 1")
+	}
+}
+
+func TestDatagramCodecReflection(t *testing.T) {
+	key := xcrypto.RandomKey(32)
+	suite := xcrypto.SuiteChaCha20Poly1305
+	client := txp.NewDatagramCodec("basic", suite, key, txp.Rekey{}, true)
+	server := txp.NewDatagramCodec("basic", suite, key, txp.Rekey{}, false)
+
+	sealed := client.Seal([]txp.Packet{ txp.NewPingPacket(1, 1) })
+
+	// Reflected back to the client, the datagram doesn't open
+	if _, err := client.Open(sealed); err == nil {
+		log.Fatalf("datagram reflected to its sender shouldn't open")
+	}
+
+	if _, err := server.Open(sealed); err != nil {
+		log.Fatalf("can't open datagram of the client. %s", err)
+	}
+
+	reply := server.Seal([]txp.Packet{ txp.NewPongPacket(1, 1) })
+
+	if _, err := server.Open(reply); err == nil {
+		log.Fatalf("datagram reflected to the server shouldn't open")
+	}
+
+	if _, err := client.Open(reply); err != nil {
+		log.Fatalf("can't open datagram of the server. %s", err)
+	}
+}
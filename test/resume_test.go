@@ -0,0 +1,103 @@
+package test
+
+import (
+	"log"
+	"bytes"
+	"time"
+	"testing"
+	txp "drill/internal/transport"
+	"drill/pkg/xcrypto"
+)
+
+func TestTicketKeys(t *testing.T) {
+	keys := txp.NewTicketKeys()
+	state := txp.ResumeState {
+		User: "alice",
+		Suite: xcrypto.SuiteAES256GCM,
+		Secret: xcrypto.RandomKey(32),
+		Issued: time.Now(),
+	}
+
+	ticket := keys.Seal(state)
+
+	opened, err := keys.Open(ticket)
+	if err != nil {
+		log.Fatalf("can't open ticket. %s", err)
+	}
+
+	if opened.User != state.User || opened.Suite != state.Suite ||
+		!bytes.Equal(opened.Secret, state.Secret) {
+		log.Fatalf("ticket opened into another state")
+	}
+
+	// Tickets of another server, e.g. a restarted one, don't open
+	if _, err := txp.NewTicketKeys().Open(ticket); err == nil {
+		log.Fatalf("ticket of other keys should be rejected")
+	}
+
+	state.Issued = time.Now().Add(-2*time.Hour)
+	if _, err := keys.Open(keys.Seal(state)); err == nil {
+		log.Fatalf("expired ticket should be rejected")
+	}
+}
+
+func TestClientTickets(t *testing.T) {
+	tickets := txp.NewClientTickets()
+
+	if _, ok := tickets.Take(); ok {
+		log.Fatalf("no ticket should be there yet")
+	}
+
+	tickets.Save(txp.ClientTicket {
+		Ticket: []byte("ticket"),
+		Received: time.Now(),
+	})
+
+	if !tickets.Ready() {
+		log.Fatalf("saved ticket should be ready")
+	}
+
+	// A ticket is used once
+	if _, ok := tickets.Take(); !ok {
+		log.Fatalf("can't take saved ticket")
+	}
+
+	if _, ok := tickets.Take(); ok {
+		log.Fatalf("ticket should be taken once")
+	}
+}
+
+func TestResumeEncoding(t *testing.T) {
+	ticket := txp.ClientTicket {
+		Ticket: xcrypto.RandomKey(80),
+		Suite: xcrypto.SuiteChaCha20Poly1305,
+		Secret: xcrypto.RandomKey(32),
+	}
+	nonce := xcrypto.RandomKey(txp.RESUME_NONCE_SIZE)
+	early := []txp.Packet{ txp.NewConnPacket(0, "example.com:443") }
+
+	// Padded like an INIT
+	pkt := txp.NewResumePacket(txp.EncodeResume("basic", ticket, nonce, early))
+
+	gotTicket, gotNonce, sealed, err := txp.ParseResume(pkt.Payload)
+	if err != nil {
+		log.Fatalf("can't parse resumption. %s", err)
+	}
+
+	if !bytes.Equal(gotTicket, ticket.Ticket) || !bytes.Equal(gotNonce, nonce) {
+		log.Fatalf("resumption parsed into another ticket or nonce")
+	}
+
+	if len(sealed) == 0 {
+		log.Fatalf("early data should be carried")
+	}
+
+	// Both sides agree on the resumed key
+	serverNonce := xcrypto.RandomKey(txp.RESUME_NONCE_SIZE)
+	clientKey := txp.DeriveResumedKey(ticket.Secret, nonce, serverNonce)
+	serverKey := txp.DeriveResumedKey(ticket.Secret, gotNonce, serverNonce)
+
+	if !bytes.Equal(clientKey, serverKey) {
+		log.Fatalf("both sides should derive the same resumed key")
+	}
+}
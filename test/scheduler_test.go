@@ -0,0 +1,104 @@
+package test
+
+import (
+	"log"
+	"time"
+	"context"
+	"testing"
+	txp "drill/internal/transport"
+)
+
+func TestSchedPolicy(t *testing.T) {
+	var policy txp.SchedPolicy
+
+	if err := policy.AddRule("*:22", "interactive", 2); err != nil {
+		log.Fatalf("can't add scheduling rule. %s", err)
+	}
+
+	if err := policy.AddRule("*.example.com:*", "bulk", 0); err != nil {
+		log.Fatalf("can't add scheduling rule. %s", err)
+	}
+
+	if err := policy.AddRule("no-port", "bulk", 1); err == nil {
+		log.Fatalf("adding rule without port should fail")
+	}
+
+	if err := policy.AddRule("*:*", "urgent", 1); err == nil {
+		log.Fatalf("adding rule with unknown class should fail")
+	}
+
+	class, weight := policy.Classify("10.0.0.1:22")
+	if class != txp.ClassInteractive || weight != 2 {
+		log.Fatalf("want interactive/2, got %v/%v", class, weight)
+	}
+
+	class, weight = policy.Classify("cdn.example.com:443")
+	if class != txp.ClassBulk || weight != 1 {
+		log.Fatalf("want bulk/1, got %v/%v", class, weight)
+	}
+
+	class, weight = policy.Classify("10.0.0.1:443")
+	if class != txp.ClassNormal || weight != 1 {
+		log.Fatalf("want normal/1, got %v/%v", class, weight)
+	}
+}
+
+func TestSchedulerFairness(t *testing.T) {
+	var policy txp.SchedPolicy
+	policy.AddRule("*:22", "interactive", 1)
+	policy.AddRule("heavy:*", "normal", 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sched := txp.NewScheduler(policy)
+	ctrlCh := make(chan txp.Packet, 16)
+	outCh := make(chan txp.Packet)
+
+	light := sched.Open(ctx, 1, "light:443")
+	heavy := sched.Open(ctx, 2, "heavy:443")
+	ssh := sched.Open(ctx, 3, "host:22")
+
+	payload := make([]byte, 1000)
+
+	for i := 0; i < 40; i++ {
+		light <- txp.NewFwdPacket(1, uint64(i), 1, 1, payload)
+		heavy <- txp.NewFwdPacket(1, uint64(i), 2, 2, payload)
+	}
+	ssh <- txp.NewFwdPacket(1, 0, 3, 3, payload)
+	ctrlCh <- txp.NewPingPacket(1, 0)
+
+	// Let the queues fill up before serving
+	time.Sleep(100*time.Millisecond)
+	go sched.Run(ctx, ctrlCh, outCh)
+
+	if pkt := <-outCh; pkt.Method != txp.PING {
+		log.Fatalf("control packet should be served first, got %v", pkt.Method)
+	}
+
+	if pkt := <-outCh; pkt.Src != 3 {
+		log.Fatalf("interactive stream should be served next, got %v", pkt.Src)
+	}
+
+	counts := make(map[uint64]int)
+	for i := 0; i < 40; i++ {
+		pkt := <-outCh
+		counts[pkt.Src] += 1
+	}
+
+	if counts[2] < 2*counts[1] {
+		log.Fatalf("weighted stream should get ~3x share, got %v", counts)
+	}
+
+	if counts[1] == 0 {
+		log.Fatalf("light stream is starved, got %v", counts)
+	}
+
+	if !sched.Urgent([]txp.Packet{ txp.NewAckPacket(1, 0, 3, 3) }) {
+		log.Fatalf("packets of interactive stream should be urgent")
+	}
+
+	if sched.Urgent([]txp.Packet{ txp.NewAckPacket(1, 0, 2, 2) }) {
+		log.Fatalf("packets of normal stream should not be urgent")
+	}
+}
@@ -0,0 +1,120 @@
+package test
+
+import (
+	"log"
+	"net"
+	"time"
+	"testing"
+	"drill/pkg/xcrypto"
+	"drill/internal/obfuscate"
+	txp "drill/internal/transport"
+)
+
+func TestShaping(t *testing.T) {
+	shaping := txp.Shaping {
+		MinPadding: 10,
+		MaxPadding: 20,
+		MinDelay: 5*time.Millisecond,
+		MaxDelay: 10*time.Millisecond,
+	}
+
+	pkt := txp.NewAuthPacket(1, []byte("auth"))
+	data := pkt.AsBytes()
+
+	for range 100 {
+		padded := shaping.Pad(data)
+
+		if n := len(padded) - len(data); n < 10 || n > 20 {
+			log.Fatalf("padding should be within [10, 20], got %v", n)
+		}
+
+		// Whatever follows the packet is ignored
+		parsed, err := txp.ParsePacket(padded)
+		if err != nil || string(parsed.Payload) != "auth" {
+			log.Fatalf("can't parse padded packet. %v", err)
+		}
+
+		if d := shaping.Delay(); d < 5*time.Millisecond || d > 10*time.Millisecond {
+			log.Fatalf("delay should be within [5ms, 10ms], got %v", d)
+		}
+	}
+
+	if (txp.Shaping{}).Delay() != 0 || len((txp.Shaping{}).Pad(data)) != len(data) {
+		log.Fatalf("zero shaping should leave datagrams as they are")
+	}
+}
+
+func TestSealedRetryToken(t *testing.T) {
+	secret := xcrypto.RandomKey(32)
+	ip := net.ParseIP("192.168.1.10").To4()
+	shaping := txp.Shaping { MinPadding: 0, MaxPadding: 32 }
+	init := []byte("the INIT behind the token")
+
+	sizes := map[int]bool{}
+
+	for range 50 {
+		token := txp.NewRetryToken(ip, secret, shaping)
+		sizes[len(token)] = true
+
+		// Neither the client's IP nor a length are in the clear
+		if string(token[:4]) == string(ip) {
+			log.Fatalf("token shouldn't show the IP")
+		}
+
+		size, ok := txp.ValidateRetryToken(append(token, init...), ip, secret)
+		if !ok || size != len(token) {
+			log.Fatalf("can't find the token in front of the INIT")
+		}
+
+		if _, ok := txp.ValidateRetryToken(token, net.ParseIP("10.0.0.1").To4(), secret); ok {
+			log.Fatalf("token of another IP should fail")
+		}
+
+		if _, ok := txp.ValidateRetryToken(token, ip, xcrypto.RandomKey(32)); ok {
+			log.Fatalf("token of another server should fail")
+		}
+
+		tampered := append([]byte{}, token...)
+		tampered[len(tampered)/2] ^= 1
+
+		if _, ok := txp.ValidateRetryToken(tampered, ip, secret); ok {
+			log.Fatalf("tampered token should fail")
+		}
+	}
+
+	if len(sizes) < 2 {
+		log.Fatalf("token size should vary")
+	}
+
+	// Junk doesn't pass for a token
+	if _, ok := txp.ValidateRetryToken(xcrypto.RandomKey(200), ip, secret); ok {
+		log.Fatalf("junk shouldn't validate")
+	}
+}
+
+func TestMaskedFirstFlight(t *testing.T) {
+	pkey := xcrypto.RandomKey(32)
+	obfs := obfuscate.BuildObfuscator("masked", pkey)
+	shaping := txp.Shaping { MinPadding: 0, MaxPadding: 64 }
+
+	pkt := txp.NewInitPacket([]byte("key agreement"))
+	sizes := map[int]bool{}
+
+	for range 50 {
+		encoded := obfs.Encode(shaping.Pad(pkt.AsBytes()))
+		sizes[len(encoded)] = true
+
+		decoded, err := obfs.Decode(encoded)
+		if err != nil {
+			log.Fatalf("can't decode padded INIT. %s", err)
+		}
+
+		if _, err := txp.ParsePacket(decoded); err != nil {
+			log.Fatalf("can't parse padded INIT. %s", err)
+		}
+	}
+
+	if len(sizes) < 2 {
+		log.Fatalf("first flight size should vary")
+	}
+}
@@ -0,0 +1,302 @@
+package test
+
+import (
+	"log"
+	"net"
+	"time"
+	"bytes"
+	"errors"
+	"syscall"
+	"context"
+	"testing"
+	"drill/pkg/netio"
+	txp "drill/internal/transport"
+)
+
+// A stream forwarding conn, the channels act as the remote side. done is
+// closed once the stream ended.
+func testStream(
+	ctx context.Context,
+	conn net.Conn,
+	idleTimeout time.Duration,
+) (chan txp.Packet, chan txp.Packet, chan struct{}) {
+	sendCh := make(chan txp.Packet, 1024)
+	recvCh := make(chan txp.Packet, 1024)
+	done := make(chan struct{})
+
+	go func() {
+		txp.RunStream(ctx, conn, sendCh, recvCh, 1, 2, 3, idleTimeout)
+		close(done)
+	}()
+
+	return sendCh, recvCh, done
+}
+
+// Both ends of a loopback TCP connection, unlike a pipe it can be reset
+func tcpPair() (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr { IP: net.IPv4(127, 0, 0, 1) })
+	if err != nil {
+		log.Fatalf("can't listen on TCP. %s", err)
+	}
+	defer listener.Close()
+
+	app, err := net.DialTCP("tcp", nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		log.Fatalf("can't connect. %s", err)
+	}
+
+	local, err := listener.AcceptTCP()
+	if err != nil {
+		log.Fatalf("can't accept. %s", err)
+	}
+
+	return local, app
+}
+
+func waitStream(done <-chan struct{}, why string) {
+	select {
+	case <-done:
+		break
+	case <-time.After(2*time.Second):
+		log.Fatalf("stream should end %s", why)
+	}
+}
+
+// Act as the remote side, ACKing every data packet until the SENDFIN, and
+// return the data in order
+func ackStream(sendCh <-chan txp.Packet, recvCh chan<-txp.Packet) []byte {
+	received := map[uint64][]byte{}
+	timeout := time.After(5*time.Second)
+
+	for {
+		var pkt txp.Packet
+
+		select {
+		case pkt = <-sendCh:
+			break
+		case <-timeout:
+			log.Fatalf("stream stalled after %v packets", len(received))
+		}
+
+		if pkt.Method == txp.FWD {
+			received[pkt.Seq] = pkt.Payload
+			recvCh <- txp.NewAckPacket(1, pkt.Seq, 3, 2)
+			continue
+		}
+
+		if pkt.Method != txp.SENDFIN {
+			continue
+		}
+
+		if pkt.Seq != uint64(len(received)) {
+			log.Fatalf(
+				"SENDFIN at %v while %v packets were received",
+				pkt.Seq,
+				len(received),
+			)
+		}
+
+		break
+	}
+
+	data := []byte{}
+	for seq := range uint64(len(received)) {
+		data = append(data, received[seq]...)
+	}
+
+	return data
+}
+
+// Several windows' worth of data
+func streamData() []byte {
+	data := make([]byte, 200*1024)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	return data
+}
+
+func TestStreamLargerThanWindow(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	local, app := net.Pipe()
+	sendCh, recvCh, _ := testStream(ctx, local, time.Minute)
+	data := streamData()
+
+	go func() {
+		app.Write(data)
+		app.Close()
+	}()
+
+	if got := ackStream(sendCh, recvCh); !bytes.Equal(got, data) {
+		log.Fatalf("want %v bytes delivered, got %v", len(data), len(got))
+	}
+}
+
+func TestStreamHalfClosed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	local, app := net.Pipe()
+	sendCh, recvCh, done := testStream(ctx, local, time.Minute)
+	data := streamData()
+
+	// The remote side is done sending before we even start
+	recvCh <- txp.NewSendFinPacket(1, 0, 3, 2)
+
+	go func() {
+		app.Write(data)
+		app.Close()
+	}()
+
+	if got := ackStream(sendCh, recvCh); !bytes.Equal(got, data) {
+		log.Fatalf("want %v bytes delivered, got %v", len(data), len(got))
+	}
+
+	waitStream(done, "once both directions are finished")
+}
+
+func TestStreamLocalReset(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	local, app := tcpPair()
+	sendCh, _, done := testStream(ctx, local, time.Minute)
+
+	// The application resets its connection, the remote side is told
+	netio.ResetTCP(app)
+
+	timeout := time.After(2*time.Second)
+
+	for rst := false; !rst; {
+		select {
+		case pkt := <-sendCh:
+			rst = pkt.Method == txp.RST
+			break
+		case <-timeout:
+			log.Fatalf("local reset should send RST")
+		}
+	}
+
+	waitStream(done, "after a local reset")
+}
+
+func TestStreamRemoteReset(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	local, app := tcpPair()
+	defer app.Close()
+
+	_, recvCh, done := testStream(ctx, local, time.Minute)
+
+	// The remote side aborts, the application sees a reset rather than EOF
+	recvCh <- txp.NewRstPacket(1, 0, 3, 2)
+
+	waitStream(done, "after a remote RST")
+
+	app.SetReadDeadline(time.Now().Add(2*time.Second))
+
+	_, err := app.Read(make([]byte, 1))
+	if !errors.Is(err, syscall.ECONNRESET) {
+		log.Fatalf("remote RST should reset the connection, got %v", err)
+	}
+}
+
+func TestStreamIdle(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	local, app := tcpPair()
+	defer app.Close()
+
+	sendCh, recvCh, done := testStream(ctx, local, 300*time.Millisecond)
+
+	// Traffic from the remote side keeps the stream up
+	for seq := range uint64(6) {
+		recvCh <- txp.NewFwdPacket(1, seq, 3, 2, []byte("keepalive"))
+		time.Sleep(100*time.Millisecond)
+	}
+
+	select {
+	case <-done:
+		log.Fatalf("active stream shouldn't be idle")
+	default:
+		break
+	}
+
+	// Then silence, the stream is reset on both sides
+	waitStream(done, "once idle")
+
+	rst := false
+	for len(sendCh) > 0 {
+		if pkt := <-sendCh; pkt.Method == txp.RST {
+			rst = true
+		}
+	}
+
+	if !rst {
+		log.Fatalf("idle stream should send RST")
+	}
+
+	app.SetReadDeadline(time.Now().Add(2*time.Second))
+
+	buf := make([]byte, 1024)
+	for {
+		if _, err := app.Read(buf); err != nil {
+			if !errors.Is(err, syscall.ECONNRESET) {
+				log.Fatalf("idle stream should reset the connection, got %v", err)
+			}
+
+			break
+		}
+	}
+}
+
+func TestSessionIdle(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// A silent session is torn down after the timeout
+	silent := txp.NewIdleTimer(200*time.Millisecond)
+	start := time.Now()
+
+	select {
+	case <-silent.Watch(ctx):
+		break
+	case <-time.After(2*time.Second):
+		log.Fatalf("silent session should be idle")
+	}
+
+	if time.Since(start) < 200*time.Millisecond {
+		log.Fatalf("session idle too early, after %v", time.Since(start))
+	}
+
+	// Activity pushes the timeout back
+	active := txp.NewIdleTimer(200*time.Millisecond)
+	activeCh := active.Watch(ctx)
+
+	for range 6 {
+		time.Sleep(100*time.Millisecond)
+		active.Touch()
+
+		select {
+		case <-activeCh:
+			log.Fatalf("active session shouldn't be idle")
+		default:
+			break
+		}
+	}
+
+	// A zero timeout never tears the session down
+	disabled := txp.NewIdleTimer(0)
+
+	select {
+	case <-disabled.Watch(ctx):
+		log.Fatalf("disabled idle timeout shouldn't fire")
+	case <-time.After(300*time.Millisecond):
+		break
+	}
+}
@@ -0,0 +1,57 @@
+package test
+
+import (
+	"log"
+	"bytes"
+	"testing"
+	txp "drill/internal/transport"
+	"drill/pkg/xcrypto"
+)
+
+func TestCipherSuites(t *testing.T) {
+	key := xcrypto.RandomKey(32)
+	plaintext := []byte("hello drill")
+
+	for _, suite := range xcrypto.AllSuites {
+		sender := xcrypto.NewSuiteXCipher(suite, key)
+		receiver := xcrypto.NewSuiteXCipher(suite, key)
+
+		ciphertext := sender.Encrypt(plaintext)
+		if len(ciphertext) != len(plaintext) + sender.Overhead() {
+			log.Fatalf("suite %v has a wrong overhead", suite)
+		}
+
+		decrypted, err := receiver.Decrypt(ciphertext)
+		if err != nil {
+			log.Fatalf("suite %v can't decrypt its own data. %s", suite, err)
+		}
+
+		if !bytes.Equal(decrypted, plaintext) {
+			log.Fatalf("suite %v decrypted into other data", suite)
+		}
+	}
+
+	// The same key under another suite opens nothing
+	chacha := xcrypto.NewSuiteXCipher(xcrypto.SuiteChaCha20Poly1305, key)
+	aes := xcrypto.NewSuiteXCipher(xcrypto.SuiteAES256GCM, key)
+
+	if _, err := aes.Decrypt(chacha.Encrypt(plaintext)); err == nil {
+		log.Fatalf("a suite shouldn't decrypt another suite's data")
+	}
+}
+
+func TestParseSuites(t *testing.T) {
+	suites, err := txp.ParseSuites(nil)
+	if err != nil || len(suites) != len(xcrypto.AllSuites) {
+		log.Fatalf("no suites should mean every suite, got %v", suites)
+	}
+
+	suites, err = txp.ParseSuites([]string{ "aes-128-gcm", "aes-128-gcm" })
+	if err != nil || len(suites) != 1 || suites[0] != xcrypto.SuiteAES128GCM {
+		log.Fatalf("duplicated suites should be listed once, got %v", suites)
+	}
+
+	if _, err := txp.ParseSuites([]string{ "rot13" }); err == nil {
+		log.Fatalf("unknown suite should be rejected")
+	}
+}
@@ -0,0 +1,50 @@
+package test
+
+import (
+	"log"
+	"testing"
+	txp "drill/internal/transport"
+	"drill/pkg/xcrypto"
+)
+
+func TestUser(t *testing.T) {
+	user, err := txp.NewUser(
+		"alice",
+		xcrypto.RandomKey(32),
+		[]string{ "*:443", "*.example.com:*" },
+		2,
+	)
+	if err != nil {
+		log.Fatalf("can't create user. %s", err)
+	}
+
+	allowed := map[string]bool {
+		"10.0.0.1:443": true,
+		"www.example.com:22": true,
+		"10.0.0.1:22": false,
+	}
+
+	for dst, want := range allowed {
+		if got := user.Allowed(dst); got != want {
+			log.Fatalf("allowed %s, want %v, got %v", dst, want, got)
+		}
+	}
+
+	if !user.OpenStream() || !user.OpenStream() {
+		log.Fatalf("user should open streams up to its limit")
+	}
+
+	if user.OpenStream() {
+		log.Fatalf("user shouldn't open streams over its limit")
+	}
+
+	user.CloseStream()
+
+	if !user.OpenStream() {
+		log.Fatalf("user should open a stream once another closed")
+	}
+
+	if _, err := txp.NewUser("bob", xcrypto.RandomKey(16), nil, 0); err == nil {
+		log.Fatalf("user key of a wrong size should be rejected")
+	}
+}